@@ -2,7 +2,7 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"runtime"
 
@@ -36,6 +36,7 @@ func main() {
 		GoalBufferMax:   12,       // Much larger buffer for demanding content
 		StreamIdleTime:  60,
 		ManagerIdleTime: 60,
+		UploadIdleTime:  600,
 		
 		// Performance optimizations with intelligent defaults
 		MaxConcurrentTranscodes: maxConcurrent,
@@ -57,8 +58,14 @@ func main() {
 		EnableTSFallback:   true,     // Fallback for older browsers
 		LowBandwidthMode:   false,    // Auto-detect based on client
 		ForceCompatibility: false,    // Let client detection decide
+
+		// Audio defaults
+		AudioChannels:      "stereo", // Downmix to stereo AAC
 	}
 
+	// Log with the defaults until the config is loaded
+	transcoder.SetupLogging(c)
+
 	// Parse arguments
 	for _, arg := range os.Args[1:] {
 		if arg == "-version-monitor" {
@@ -78,6 +85,6 @@ func main() {
 	code := transcoder.NewHandler(c).Start()
 
 	// Exit
-	log.Println("Exiting go-vod with status code", code)
+	slog.Info("exiting go-vod", "status", code)
 	os.Exit(code)
 }
@@ -0,0 +1,185 @@
+package transcoder
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// Status of a manager for the admin API
+type managerStatus struct {
+	ID       string           `json:"id"`
+	Path     string           `json:"path"`
+	Inactive int              `json:"inactive"`
+	Probe    *ProbeVideoData  `json:"probe"`
+	Disk     map[string]int64 `json:"disk"` // bytes by stream
+	Streams  []*streamStatus  `json:"streams"`
+}
+
+type streamStatus struct {
+	Quality  string `json:"quality"`
+	Codec    string `json:"codec"`
+	FMP4     bool   `json:"fmp4"`
+	Goal     int    `json:"goal"`
+	Inactive int    `json:"inactive"`
+	Pending  int    `json:"pending"` // chunk to start at once admitted (-1 = none)
+	PID      int    `json:"pid,omitempty"`
+	Running  bool   `json:"running"` // coder holds a slot (else stopped or idle)
+	Done     []int  `json:"done"`    // finished chunks
+	Waiting  []int  `json:"waiting"` // chunks being transcoded
+	Waiters  int    `json:"waiters"` // players waiting for chunks
+}
+
+// Serve the admin API. The parts are those after /admin.
+//
+//	GET    /admin/managers                      all managers
+//	GET    /admin/managers/<streamid>           one manager
+//	DELETE /admin/managers/<streamid>           destroy the manager
+//	DELETE /admin/managers/<streamid>/<quality> stop transcoding a stream
+//
+// Stopping a stream kills ffmpeg and drops its chunks like the idle
+// timeout does; it starts again on the next request for a chunk.
+func (h *Handler) ServeAdmin(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 || parts[0] != "managers" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// List all managers
+	if len(parts) == 1 {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		h.mutex.RLock()
+		managers := make([]*Manager, 0, len(h.managers))
+		for _, m := range h.managers {
+			managers = append(managers, m)
+		}
+		h.mutex.RUnlock()
+
+		sort.Slice(managers, func(i, j int) bool {
+			return managers[i].id < managers[j].id
+		})
+
+		status := make([]*managerStatus, 0, len(managers))
+		for _, m := range managers {
+			status = append(status, h.managerStatus(m))
+		}
+		writeJSON(w, status)
+		return
+	}
+
+	h.mutex.RLock()
+	m := h.managers[parts[1]]
+	h.mutex.RUnlock()
+
+	if m == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Manager
+	if len(parts) == 2 {
+		switch r.Method {
+		case "GET":
+			writeJSON(w, h.managerStatus(m))
+		case "DELETE":
+			m.logger().Info("destroyed by admin")
+			h.destroyManager(m)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	// Stream
+	s := m.streams[parts[2]]
+	if s == nil || len(parts) > 3 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if r.Method != "DELETE" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.logger().Info("stopped by admin")
+	s.mutex.Lock()
+	s.clear()
+	s.mutex.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) managerStatus(m *Manager) *managerStatus {
+	m.mutex.Lock()
+	inactive := m.inactive
+	m.mutex.Unlock()
+
+	status := &managerStatus{
+		ID:       m.id,
+		Path:     m.path,
+		Inactive: inactive,
+		Probe:    m.probe,
+		Disk:     m.diskUsage(),
+		Streams:  make([]*streamStatus, 0, len(m.streams)),
+	}
+
+	qualities := make([]string, 0, len(m.streams))
+	for quality := range m.streams {
+		qualities = append(qualities, quality)
+	}
+	sort.Strings(qualities)
+
+	for _, quality := range qualities {
+		status.Streams = append(status.Streams, h.streamStatus(m.streams[quality]))
+	}
+	return status
+}
+
+func (h *Handler) streamStatus(s *Stream) *streamStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	status := &streamStatus{
+		Quality:  s.quality,
+		FMP4:     s.fmp4(),
+		Goal:     s.goal,
+		Inactive: s.inactive,
+		Pending:  s.pending,
+		Done:     make([]int, 0),
+		Waiting:  make([]int, 0),
+	}
+
+	if s.audio != nil {
+		status.Codec = s.audioCodecString()
+	} else {
+		status.Codec = s.encoder.Profile(s).String()
+	}
+
+	if s.coder != nil && s.coder.Process != nil {
+		status.PID = s.coder.Process.Pid
+		status.Running = h.sched.Running(s)
+	}
+
+	for id, chunk := range s.chunks {
+		if chunk.done {
+			status.Done = append(status.Done, id)
+		} else {
+			status.Waiting = append(status.Waiting, id)
+		}
+		status.Waiters += len(chunk.notifs)
+	}
+	sort.Ints(status.Done)
+	sort.Ints(status.Waiting)
+
+	return status
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,291 @@
+package transcoder
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	QUALITY_AUDIO = "audio"
+	AUDIO_GROUP   = "audio"
+
+	// Audio channel policies
+	AUDIO_CHANNELS_MONO     = "mono"
+	AUDIO_CHANNELS_STEREO   = "stereo"
+	AUDIO_CHANNELS_SURROUND = "5.1"
+	AUDIO_CHANNELS_SOURCE   = "source"
+
+	// Default AAC bitrate per channel
+	AUDIO_BITRATE_CHANNEL = 64000
+
+	// Audio codecs that can be passed through
+	CODEC_AC3  = "ac3"
+	CODEC_EAC3 = "eac3"
+)
+
+// Create audio-only streams for every audio track of the source.
+// Each distinct audio bitrate of the video streams gets its own group
+// of renditions, named audio0_128k, audio1_128k, ... after the index of
+// the track (or audio0, audio1, ... for the automatic bitrate).
+// AC-3 and E-AC-3 tracks also get a passthrough rendition audio0_copy.
+func (m *Manager) addAudioStreams() {
+	if len(m.probe.Audio) == 0 {
+		return
+	}
+
+	video := make([]*Stream, 0)
+	for _, stream := range m.streams {
+		if stream.audio == nil {
+			video = append(video, stream)
+		}
+	}
+
+	for _, vs := range video {
+		bitrate := m.c.AudioBitrates[vs.quality]
+		vs.audioGroup = audioGroupName(bitrate)
+
+		for _, audio := range m.probe.Audio {
+			quality := audioQuality(audio, bitrate, false)
+			if _, ok := m.streams[quality]; ok {
+				continue
+			}
+
+			stream := &Stream{
+				c: m.c, m: m,
+				quality:    quality,
+				order:      2,
+				audio:      audio,
+				audioGroup: vs.audioGroup,
+				pending:    -1,
+			}
+			stream.bitrate = stream.audioBitrate(bitrate)
+			m.streams[quality] = stream
+		}
+	}
+
+	for _, audio := range m.probe.Audio {
+		if audio.CodecName != CODEC_AC3 && audio.CodecName != CODEC_EAC3 {
+			continue
+		}
+
+		bitrate := audio.BitRate
+		if bitrate == 0 {
+			bitrate = 640000
+		}
+
+		quality := audioQuality(audio, 0, true)
+		m.streams[quality] = &Stream{
+			c: m.c, m: m,
+			quality:   quality,
+			bitrate:   bitrate,
+			order:     2,
+			audio:     audio,
+			audioCopy: true,
+			pending:   -1,
+		}
+	}
+}
+
+func audioGroupName(bitrate int) string {
+	if bitrate == 0 {
+		return AUDIO_GROUP
+	}
+	return fmt.Sprintf("%s%dk", AUDIO_GROUP, bitrate/1000)
+}
+
+func audioQuality(audio *ProbeAudioData, bitrate int, passthrough bool) string {
+	if passthrough {
+		return fmt.Sprintf("%s%d_copy", QUALITY_AUDIO, audio.Index)
+	} else if bitrate == 0 {
+		return fmt.Sprintf("%s%d", QUALITY_AUDIO, audio.Index)
+	}
+	return fmt.Sprintf("%s%d_%dk", QUALITY_AUDIO, audio.Index, bitrate/1000)
+}
+
+// Audio codecs the client can play without transcoding,
+// e.g. "X-Go-Vod-Audio-Codecs: ac3,eac3"
+func clientAudioCodecs(r *http.Request) map[string]bool {
+	return parseCodecList(r.Header.Get("X-Go-Vod-Audio-Codecs"))
+}
+
+// Renditions of a group of audio tracks as listed to a client
+type audioGroup struct {
+	streams []*Stream
+	bitrate int      // highest bitrate of the renditions
+	codecs  []string // CODECS of all renditions
+}
+
+// Get the rendition of each track in the given group for the client,
+// in the container of the client.
+// Passthrough is preferred when the client supports the source codec.
+func (m *Manager) audioGroup(group string, client *ClientProfile) *audioGroup {
+	g := &audioGroup{streams: make([]*Stream, 0), codecs: make([]string, 0)}
+	seen := make(map[string]bool)
+
+	for _, audio := range m.probe.Audio {
+		var stream *Stream
+		if client.AudioCodecs[audio.CodecName] {
+			stream = m.streams[containerQuality(audioQuality(audio, 0, true), client.FMP4)]
+		}
+		if stream == nil {
+			for _, s := range m.streams {
+				if s.audio == audio && !s.audioCopy && s.audioGroup == group && s.fmp4Twin == client.FMP4 {
+					stream = s
+					break
+				}
+			}
+		}
+		if stream == nil {
+			continue
+		}
+
+		g.streams = append(g.streams, stream)
+		if stream.bitrate > g.bitrate {
+			g.bitrate = stream.bitrate
+		}
+		if codec := stream.audioCodecString(); !seen[codec] {
+			seen[codec] = true
+			g.codecs = append(g.codecs, codec)
+		}
+	}
+
+	sort.Strings(g.codecs)
+	return g
+}
+
+// Write EXT-X-MEDIA tags for all audio renditions.
+// Returns the renditions listed for each group.
+func (m *Manager) writeAudioMedia(w http.ResponseWriter, client *ClientProfile, query string) map[string]*audioGroup {
+	groups := make(map[string]*audioGroup)
+
+	// Get the groups in a stable order
+	names := make([]string, 0)
+	for _, stream := range m.streams {
+		if stream.audio == nil && stream.audioGroup != "" && groups[stream.audioGroup] == nil {
+			groups[stream.audioGroup] = m.audioGroup(stream.audioGroup, client)
+			names = append(names, stream.audioGroup)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		streams := groups[name].streams
+
+		// Default to the first track unless one is marked
+		def := 0
+		for i, stream := range streams {
+			if stream.audio.Default {
+				def = i
+				break
+			}
+		}
+
+		for i, stream := range streams {
+			media := fmt.Sprintf("#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"%s\",NAME=\"%s\"", name, stream.audio.Name())
+
+			if lang := stream.audio.Language; lang != "" && lang != "und" {
+				media += fmt.Sprintf(",LANGUAGE=\"%s\"", lang)
+			}
+
+			if i == def {
+				media += ",DEFAULT=YES,AUTOSELECT=YES"
+			} else {
+				media += ",DEFAULT=NO,AUTOSELECT=YES"
+			}
+
+			media += fmt.Sprintf(",CHANNELS=\"%d\"", stream.audioChannels())
+			media += fmt.Sprintf(",URI=\"%s.m3u8%s\"\n", stream.quality, query)
+			w.Write([]byte(media))
+		}
+	}
+
+	return groups
+}
+
+// Display name of an audio track for players
+func (a *ProbeAudioData) Name() string {
+	name := a.Title
+	if name == "" && a.Language != "" && a.Language != "und" {
+		name = a.Language
+	}
+	if name == "" {
+		name = fmt.Sprintf("Track %d", a.Index+1)
+	}
+
+	// Quotes cannot be escaped in attribute values
+	return strings.ReplaceAll(name, "\"", "'")
+}
+
+// Number of output channels according to the channel policy
+func (s *Stream) audioChannels() int {
+	source := s.audio.Channels
+	if source <= 0 {
+		source = 2
+	}
+
+	if s.audioCopy {
+		return source
+	}
+
+	max := 2
+	switch s.c.AudioChannels {
+	case AUDIO_CHANNELS_MONO:
+		max = 1
+	case AUDIO_CHANNELS_SURROUND:
+		max = 6
+	case AUDIO_CHANNELS_SOURCE:
+		max = 8 // most AAC decoders handle up to 7.1
+	}
+
+	if source < max {
+		return source
+	}
+	return max
+}
+
+// AAC bitrate for the given tier bitrate (0 = automatic)
+func (s *Stream) audioBitrate(bitrate int) int {
+	if bitrate > 0 {
+		return bitrate
+	}
+	return AUDIO_BITRATE_CHANNEL * s.audioChannels()
+}
+
+// Value of the CODECS attribute for the audio of this stream
+func (s *Stream) audioCodecString() string {
+	if s.audioCopy {
+		if s.audio.CodecName == CODEC_EAC3 {
+			return "ec-3"
+		}
+		return "ac-3"
+	}
+	return "mp4a.40.2"
+}
+
+// Arguments to encode the audio track to AAC
+func (s *Stream) audioEncodeArgs() []string {
+	if s.audioCopy {
+		return []string{"-c:a", "copy"}
+	}
+
+	return []string{
+		"-c:a", "aac",
+		"-ac", fmt.Sprintf("%d", s.audioChannels()),
+		"-b:a", fmt.Sprintf("%d", s.bitrate),
+	}
+}
+
+// Get arguments to ffmpeg for an audio-only stream
+func (s *Stream) audioArgs() []string {
+	args := []string{
+		"-i", s.m.path, // Input file
+		"-copyts", // So the "-to" refers to the original TS
+		"-fflags", "+genpts",
+
+		"-map", fmt.Sprintf("0:a:%d", s.audio.Index),
+	}
+
+	return append(args, s.audioEncodeArgs()...)
+}
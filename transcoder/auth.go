@@ -0,0 +1,80 @@
+package transcoder
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Requests for a stream are signed with Config.Secret. The signature
+// is the hex HMAC-SHA256 of "<streamid>\n<path>\n<expires>", where
+// expires is a unix timestamp, and is passed in the query string:
+//
+//	/<streamid>/<path>/index.m3u8?expires=1700000000&signature=...
+//
+// The query is carried over to all playlists and chunks, so one
+// signature covers every file of the stream until it expires.
+// Requests with Config.AdminToken are always allowed; the token is
+// required for /config and for uploading files. The admin API and
+// the metrics are only served with the token, so they are disabled
+// if no token is configured.
+
+// Compute the signature of a stream request
+func (c *Config) Sign(streamid string, path string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(c.Secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d", streamid, path, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check the signature of a request for the stream.
+// Always true if no secret is configured.
+func (h *Handler) authorized(r *http.Request, streamid string, path string) bool {
+	if h.c.Secret == "" || h.isAdmin(r) {
+		return true
+	}
+
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	signature, err := hex.DecodeString(query.Get("signature"))
+	if err != nil {
+		return false
+	}
+
+	expected, _ := hex.DecodeString(h.c.Sign(streamid, path, expires))
+	return hmac.Equal(signature, expected)
+}
+
+// Check the admin token of the request. Without a token admin
+// requests are only allowed if there is no secret either, which
+// is the behavior of an unconfigured server.
+func (h *Handler) isAdmin(r *http.Request) bool {
+	if h.c.AdminToken == "" {
+		return h.c.Secret == ""
+	}
+	return h.hasAdminToken(r)
+}
+
+// Check that an admin token is configured and sent with the request
+func (h *Handler) hasAdminToken(r *http.Request) bool {
+	if h.c.AdminToken == "" {
+		return false
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.c.AdminToken)) == 1
+}
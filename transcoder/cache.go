@@ -0,0 +1,248 @@
+package transcoder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SegmentCache keeps finished chunks on disk across sessions. It is
+// shared by all managers of a Handler. Chunks are addressed by a hash
+// of the source file identity and the encoding parameters, so any
+// manager transcoding the same file with the same settings can serve
+// them without ffmpeg. The least recently used chunks are evicted
+// once the cache grows beyond its budget.
+type SegmentCache struct {
+	dir    string
+	budget int64
+
+	mutex   sync.Mutex
+	entries map[string]*cacheEntry // by file name
+	size    int64
+}
+
+type cacheEntry struct {
+	size int64
+	used time.Time
+}
+
+// Create the segment cache in the cache directory.
+// Returns nil if the cache is disabled.
+func NewSegmentCache(c *Config) *SegmentCache {
+	if c.SegmentCacheSize <= 0 {
+		return nil
+	}
+
+	sc := &SegmentCache{
+		dir:     filepath.Join(c.CacheDir, "segments"),
+		budget:  int64(c.SegmentCacheSize) * 1024 * 1024,
+		entries: make(map[string]*cacheEntry),
+	}
+	os.MkdirAll(sc.dir, 0755)
+
+	// Pick up chunks of earlier runs. Leftover temp
+	// files are from copies that were interrupted.
+	files, err := ioutil.ReadDir(sc.dir)
+	if err != nil {
+		slog.Warn("could not read segment cache", "err", err)
+	}
+	for _, info := range files {
+		if strings.Contains(info.Name(), ".tmp-") {
+			os.Remove(filepath.Join(sc.dir, info.Name()))
+			continue
+		}
+		sc.entries[info.Name()] = &cacheEntry{size: info.Size(), used: info.ModTime()}
+		sc.size += info.Size()
+	}
+
+	sc.mutex.Lock()
+	sc.evict()
+	sc.mutex.Unlock()
+
+	slog.Info("segment cache loaded", "chunks", len(sc.entries), "bytes", sc.size)
+	return sc
+}
+
+// Open a cached chunk. Returns the open file and its size, or nil
+// if the chunk is not in the cache. The file is opened with lock
+// held, so it stays readable even if it is evicted before it is
+// served. The caller must close it.
+func (sc *SegmentCache) Open(key string) (*os.File, int64) {
+	if sc == nil || key == "" {
+		return nil, 0
+	}
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	e := sc.entries[key]
+	if e == nil {
+		return nil, 0
+	}
+
+	path := filepath.Join(sc.dir, key)
+	f, err := os.Open(path)
+	if err != nil {
+		// Removed behind our back; transcode it again
+		slog.Warn("could not open cached chunk", "key", key, "err", err)
+		sc.size -= e.size
+		delete(sc.entries, key)
+		return nil, 0
+	}
+
+	// Keep the time of use across restarts
+	e.used = time.Now()
+	os.Chtimes(path, e.used, e.used)
+
+	return f, e.size
+}
+
+// Check if a chunk is in the cache, without using it
+func (sc *SegmentCache) Has(key string) bool {
+	if sc == nil || key == "" {
+		return false
+	}
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	return sc.entries[key] != nil
+}
+
+// Add a chunk to the cache. The chunk is the given range of the file,
+// or the whole file if the range is nil. Files are hard linked when
+// possible, so this is cheap for chunks with their own file.
+func (sc *SegmentCache) Put(key string, src string, r *byteRange) {
+	if sc == nil || key == "" {
+		return
+	}
+
+	sc.mutex.Lock()
+	exists := sc.entries[key] != nil
+	sc.mutex.Unlock()
+	if exists {
+		return
+	}
+
+	dst := filepath.Join(sc.dir, key)
+	var err error
+	if r != nil {
+		err = copyRange(src, dst, r)
+	} else if err = os.Link(src, dst); err != nil {
+		err = copyFile(src, dst)
+	}
+	if err != nil {
+		slog.Warn("could not add to segment cache", "key", key, "err", err)
+		return
+	}
+
+	info, err := os.Stat(dst)
+	if err != nil {
+		return
+	}
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	if sc.entries[key] == nil {
+		sc.entries[key] = &cacheEntry{size: info.Size(), used: time.Now()}
+		sc.size += info.Size()
+	}
+	sc.evict()
+}
+
+// Remove the least recently used chunks until the cache fits
+// into its budget. Must be called with lock held.
+func (sc *SegmentCache) evict() {
+	if sc.size <= sc.budget {
+		return
+	}
+
+	keys := make([]string, 0, len(sc.entries))
+	for key := range sc.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return sc.entries[keys[i]].used.Before(sc.entries[keys[j]].used)
+	})
+
+	for _, key := range keys {
+		if sc.size <= sc.budget {
+			break
+		}
+
+		// Open files are still readable after removal
+		os.Remove(filepath.Join(sc.dir, key))
+		sc.size -= sc.entries[key].size
+		delete(sc.entries, key)
+	}
+}
+
+// Get the cache key of a chunk, or of the init segment for id -1.
+// Returns an empty key if the cache is disabled.
+// Must be called with lock held.
+func (s *Stream) cacheKey(id int) string {
+	if s.m.cache == nil {
+		return ""
+	}
+
+	// Everything that changes the output: the identity of the
+	// source and the arguments to ffmpeg apart from the start
+	if s.cacheBase == "" {
+		info, err := os.Stat(s.m.path)
+		if err != nil {
+			return ""
+		}
+
+		h := sha256.New()
+		fmt.Fprintf(h, "%s:%d:%d\n", s.m.path, info.Size(), info.ModTime().UnixNano())
+		fmt.Fprintf(h, "%s:%t\n", strings.Join(s.transcodeArgs(0, true), " "), s.fmp4())
+		if s.audio == nil {
+			fmt.Fprintf(h, "%s\n", strings.Join(s.encoder.KeyframeArgs(s, 0), " "))
+		}
+		s.cacheBase = hex.EncodeToString(h.Sum(nil))
+	}
+
+	ext := "ts"
+	if s.fmp4() {
+		ext = "mp4"
+	}
+
+	if id == -1 {
+		return fmt.Sprintf("%s-init.%s", s.cacheBase, ext)
+	}
+
+	// Chunk boundaries are part of the key
+	return fmt.Sprintf("%s-%06d-%.3f-%.3f.%s", s.cacheBase, id, s.chunkStart(id), s.chunkEnd(id), ext)
+}
+
+// Copy a file to a new file. The new file is only
+// visible once it is complete.
+func copyFile(src string, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	return copyRange(src, dst, &byteRange{offset: 0, length: info.Size()})
+}
+
+// Get the first chunk after the given one that is not in the cache,
+// looking at most GoalBufferMax chunks ahead. Chunks of this session
+// stop the search, since checkGoal knows about them.
+// Must be called with lock held.
+func (s *Stream) nextUncached(id int) int {
+	next := id + 1
+	for ; next < len(s.segments) && next < id+s.c.GoalBufferMax; next++ {
+		if _, ok := s.chunks[next]; ok || !s.m.cache.Has(s.cacheKey(next)) {
+			break
+		}
+	}
+	return next
+}
@@ -4,6 +4,12 @@ type Chunk struct {
 	id     int
 	done   bool
 	notifs []chan bool
+
+	// Byte range in the single file of a coder;
+	// empty file if the chunk has its own file
+	file   string
+	offset int64
+	length int64
 }
 
 func NewChunk(id int) *Chunk {
@@ -0,0 +1,146 @@
+package transcoder
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Capabilities of the client of a session, derived from the request
+// headers. The profile decides the segment container, the HLS version
+// and which streams are listed, so that one limited client does not
+// change the shared Config for everybody else.
+type ClientProfile struct {
+	FMP4         bool // fMP4 instead of MPEG-TS segments
+	HLSVersion   int
+	MaxHeight    int  // tallest stream to list (0 = no limit)
+	LowBandwidth bool // device with limited bandwidth (e.g. TV)
+
+	VideoCodecs map[string]bool
+	AudioCodecs map[string]bool
+}
+
+func NewClientProfile(c *Config, r *http.Request) *ClientProfile {
+	p := &ClientProfile{
+		HLSVersion:   c.HLSVersion,
+		LowBandwidth: c.LowBandwidthMode,
+		VideoCodecs:  clientVideoCodecs(r),
+		AudioCodecs:  clientAudioCodecs(r),
+	}
+
+	if p.HLSVersion <= 0 {
+		p.HLSVersion = 3
+	}
+
+	ua := strings.ToLower(r.Header.Get("User-Agent"))
+	compatibility := c.ForceCompatibility
+
+	if c.EnableClientHints {
+		// TV browsers get the low bandwidth ladder
+		if isTV(ua) {
+			p.LowBandwidth = true
+		}
+
+		// Unknown browsers get conservative settings
+		if browserName(ua) == "unknown" {
+			compatibility = true
+		}
+	}
+
+	// Determine optimal format based on client
+	useMP4 := c.EnableFMP4 && !compatibility
+
+	// Force TS for problematic browsers/devices
+	if strings.Contains(ua, "firefox") ||
+		strings.Contains(ua, "tv") ||
+		strings.Contains(ua, "webview") ||
+		p.LowBandwidth {
+		useMP4 = false
+		p.HLSVersion = 3 // More compatible version
+	}
+
+	// Chrome/Safari can use fMP4 for better efficiency
+	if useMP4 && (strings.Contains(ua, "chrome") || strings.Contains(ua, "safari") || strings.Contains(ua, "edge")) {
+		p.FMP4 = true
+		p.HLSVersion = 6
+	}
+
+	// No high resolutions on limited devices
+	if p.LowBandwidth {
+		p.MaxHeight = 1080
+	}
+
+	return p
+}
+
+func isTV(ua string) bool {
+	return strings.Contains(ua, "tv") || strings.Contains(ua, "smarttv") || strings.Contains(ua, "roku") || strings.Contains(ua, "chromecast")
+}
+
+// Browser family from the lowercase User-Agent
+func browserName(ua string) string {
+	if strings.Contains(ua, "chrome") && !strings.Contains(ua, "edg") {
+		return "chrome"
+	} else if strings.Contains(ua, "edg") {
+		return "edge"
+	} else if strings.Contains(ua, "firefox") {
+		return "firefox"
+	} else if strings.Contains(ua, "safari") {
+		return "safari"
+	} else if strings.Contains(ua, "brave") {
+		return "brave"
+	} else if strings.Contains(ua, "opera") {
+		return "opera"
+	}
+	return "unknown"
+}
+
+// Get the video streams to list to the client, sorted by bitrate.
+// Streams in both containers are listed in the one of the client.
+// If none fit the size limit, all streams the client can decode are
+// listed instead.
+func (m *Manager) clientStreams(p *ClientProfile) []*Stream {
+	all := make([]*Stream, 0)
+	fit := make([]*Stream, 0)
+	for _, stream := range m.streams {
+		if stream.audio != nil || !p.VideoCodecs[stream.videoCodec()] || !p.allowsContainer(stream) {
+			continue
+		}
+		all = append(all, stream)
+
+		// The smaller dimension is the height of the ladder
+		size := stream.height
+		if stream.width < size {
+			size = stream.width
+		}
+		if p.MaxHeight == 0 || size <= p.MaxHeight {
+			fit = append(fit, stream)
+		}
+	}
+
+	if len(fit) == 0 {
+		fit = all
+	}
+	sortStreams(fit)
+	return fit
+}
+
+// Get the client profile of the session
+func (m *Manager) getClient() *ClientProfile {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.client
+}
+
+// Update the client profile of the session from a request
+// for the master playlist or the manifest
+func (m *Manager) setClient(p *ClientProfile) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.client = p
+}
+
+// Check if the stream is in the container of the client.
+// HEVC and AV1 only exist as fMP4.
+func (p *ClientProfile) allowsContainer(s *Stream) bool {
+	return s.fmp4Only() || s.fmp4Twin == p.FMP4
+}
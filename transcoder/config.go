@@ -2,8 +2,9 @@ package transcoder
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 )
@@ -21,12 +22,35 @@ type Config struct {
 	// Bind address
 	Bind string `json:"bind"`
 
+	// Log level (debug, info, warn, error) and format (text, json)
+	LogLevel  string `json:"logLevel"`
+	LogFormat string `json:"logFormat"`
+
+	// Shared secret for signed stream URLs (empty = no signatures)
+	Secret string `json:"secret"`
+	// Token for /config and uploads (Authorization: Bearer)
+	AdminToken string `json:"adminToken"`
+	// Directories with the source files (empty = any path)
+	AllowedRoots []string `json:"allowedRoots"`
+
 	// FFmpeg binary
 	FFmpeg string `json:"ffmpeg"`
 	// FFprobe binary
 	FFprobe string `json:"ffprobe"`
 	// Temp files directory
 	TempDir string `json:"tempdir"`
+	// Maximum size of the temp directory in MB (0 = unlimited)
+	TempDirQuota int `json:"tempDirQuota"`
+	// Minimum free space to keep on the temp file system in MB (0 = no check)
+	MinFreeSpace int `json:"minFreeSpace"`
+	// Maximum size of an uploaded temp file in MB (0 = unlimited)
+	MaxUploadSize int `json:"maxUploadSize"`
+	// Seconds after which an unfinished resumable upload is removed
+	UploadIdleTime int `json:"uploadIdleTime"`
+	// Persistent cache directory (keyframe indexes)
+	CacheDir string `json:"cacheDir"`
+	// Size of the cache of finished chunks in MB (0 = disabled)
+	SegmentCacheSize int `json:"segmentCacheSize"`
 
 	// Size of each chunk in seconds
 	ChunkSize int `json:"chunkSize"`
@@ -45,6 +69,24 @@ type Config struct {
 	// Quality Factor (e.g. CRF / global_quality)
 	QF int `json:"qf"`
 
+	// Audio channel policy (mono, stereo, 5.1, source)
+	AudioChannels string `json:"audioChannels"`
+	// Audio bitrate in bps per quality (e.g. "720p": 128000).
+	// Qualities not listed get 64kbps per channel.
+	AudioBitrates map[string]int `json:"audioBitrates"`
+
+	// Video encoder (ffmpeg codec name, e.g. libx264, h264_nvenc).
+	// If empty, chosen from the hardware acceleration flags below.
+	Encoder string `json:"encoder"`
+
+	// Additional HEVC and AV1 variants for clients that can decode them
+	HEVC bool `json:"hevc"`
+	AV1  bool `json:"av1"`
+	// Encoders of the variants (e.g. hevc_nvenc, libsvtav1).
+	// If empty, chosen from the hardware acceleration flags below.
+	HEVCEncoder string `json:"hevcEncoder"`
+	AV1Encoder  string `json:"av1Encoder"`
+
 	// Hardware acceleration configuration
 
 	// VA-API
@@ -56,6 +98,9 @@ type Config struct {
 	NVENCTemporalAQ bool   `json:"nvencTemporalAQ"`
 	NVENCScale      string `json:"nvencScale"` // cuda, npp
 
+	// Intel Quick Sync Video
+	QSV bool `json:"qsv"`
+
 	// Use transpose workaround for streaming (VA-API)
 	UseTranspose bool `json:"useTranspose"`
 
@@ -86,6 +131,7 @@ type Config struct {
 	// HLS compatibility settings
 	HLSVersion          int    `json:"hlsVersion"`          // HLS protocol version (3, 4, 6)
 	EnableFMP4          bool   `json:"enableFMP4"`          // Enable fMP4 segments for modern browsers
+	FMP4SingleFile      bool   `json:"fmp4SingleFile"`      // Write fMP4 to one file per encode, served with byte ranges
 	EnableTSFallback    bool   `json:"enableTSFallback"`    // Fallback to TS for compatibility
 	LowBandwidthMode    bool   `json:"lowBandwidthMode"`    // Special mode for limited devices
 	ForceCompatibility  bool   `json:"forceCompatibility"`  // Force maximum compatibility mode
@@ -95,16 +141,19 @@ func (c *Config) FromFile(path string) {
 	// load json config
 	content, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Fatal("Error when opening file: ", err)
+		slog.Error("could not open config file", "path", path, "err", err)
+		os.Exit(1)
 	}
 
 	err = json.Unmarshal(content, &c)
 	if err != nil {
-		log.Fatal("Error loading config file", err)
+		slog.Error("could not load config file", "path", path, "err", err)
+		os.Exit(1)
 	}
 
 	// Set config as loaded
 	c.Configured = true
+	SetupLogging(c)
 	c.Print()
 }
 
@@ -113,12 +162,14 @@ func (c *Config) AutoDetect() {
 	if c.FFmpeg == "" || c.FFprobe == "" {
 		ffmpeg, err := exec.LookPath("ffmpeg")
 		if err != nil {
-			log.Fatal("Could not find ffmpeg")
+			slog.Error("could not find ffmpeg")
+			os.Exit(1)
 		}
 
 		ffprobe, err := exec.LookPath("ffprobe")
 		if err != nil {
-			log.Fatal("Could not find ffprobe")
+			slog.Error("could not find ffprobe")
+			os.Exit(1)
 		}
 
 		c.FFmpeg = ffmpeg
@@ -130,10 +181,24 @@ func (c *Config) AutoDetect() {
 		c.TempDir = os.TempDir() + "/go-vod"
 	}
 
+	// Auto-choose cache dir; this must not be inside
+	// the tempdir since that is cleared on startup
+	if c.CacheDir == "" {
+		c.CacheDir = os.TempDir() + "/go-vod-cache"
+	}
+
 	// Print updated config
 	c.Print()
 }
 
 func (c *Config) Print() {
-	log.Printf("%+v\n", c)
+	// Do not log the credentials
+	p := *c
+	if p.Secret != "" {
+		p.Secret = "***"
+	}
+	if p.AdminToken != "" {
+		p.AdminToken = "***"
+	}
+	slog.Info("config", "config", fmt.Sprintf("%+v", &p))
 }
@@ -0,0 +1,45 @@
+package transcoder
+
+// Suffix of the fMP4 twin of a stream, e.g. 720p_fmp4.
+// Streams without the suffix are segmented as MPEG-TS.
+const FMP4_SUFFIX = "_fmp4"
+
+// Create an fMP4 twin of every stream that is not fMP4 already, so
+// that clients needing MPEG-TS and clients preferring fMP4 can watch
+// the same video at the same time. Twins only transcode on request.
+func (m *Manager) addContainerTwins() {
+	streams := make([]*Stream, 0)
+	for _, stream := range m.streams {
+		if !stream.fmp4() {
+			streams = append(streams, stream)
+		}
+	}
+
+	for _, s := range streams {
+		quality := containerQuality(s.quality, true)
+		m.streams[quality] = &Stream{
+			c: s.c, m: s.m,
+			quality:    quality,
+			order:      s.order,
+			height:     s.height,
+			width:      s.width,
+			bitrate:    s.bitrate,
+			encoder:    s.encoder,
+			segments:   s.segments,
+			aligned:    s.aligned,
+			audio:      s.audio,
+			audioCopy:  s.audioCopy,
+			audioGroup: s.audioGroup,
+			fmp4Twin:   true,
+			pending:    -1,
+		}
+	}
+}
+
+// Name of the stream of the given quality in a container
+func containerQuality(quality string, fmp4 bool) string {
+	if fmp4 {
+		return quality + FMP4_SUFFIX
+	}
+	return quality
+}
@@ -0,0 +1,242 @@
+package transcoder
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+)
+
+// Timescale of the segment timelines (milliseconds)
+const DASH_TIMESCALE = 1000
+
+type mpd struct {
+	XMLName                   xml.Name  `xml:"MPD"`
+	Xmlns                     string    `xml:"xmlns,attr"`
+	Profiles                  string    `xml:"profiles,attr"`
+	Type                      string    `xml:"type,attr"`
+	MediaPresentationDuration string    `xml:"mediaPresentationDuration,attr"`
+	MinBufferTime             string    `xml:"minBufferTime,attr"`
+	Period                    mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	ID   string              `xml:"id,attr"`
+	Sets []*mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	ID               int                  `xml:"id,attr"`
+	ContentType      string               `xml:"contentType,attr"`
+	MimeType         string               `xml:"mimeType,attr"`
+	Lang             string               `xml:"lang,attr,omitempty"`
+	SegmentAlignment bool                 `xml:"segmentAlignment,attr"`
+	StartWithSAP     int                  `xml:"startWithSAP,attr"`
+	Role             *mpdDescriptor       `xml:"Role,omitempty"`
+	Representations  []*mpdRepresentation `xml:"Representation"`
+}
+
+type mpdDescriptor struct {
+	SchemeIdUri string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+}
+
+type mpdRepresentation struct {
+	ID                        string             `xml:"id,attr"`
+	Bandwidth                 int                `xml:"bandwidth,attr"`
+	Codecs                    string             `xml:"codecs,attr"`
+	Width                     int                `xml:"width,attr,omitempty"`
+	Height                    int                `xml:"height,attr,omitempty"`
+	FrameRate                 int                `xml:"frameRate,attr,omitempty"`
+	AudioChannelConfiguration *mpdDescriptor     `xml:"AudioChannelConfiguration,omitempty"`
+	SegmentTemplate           mpdSegmentTemplate `xml:"SegmentTemplate"`
+}
+
+type mpdSegmentTemplate struct {
+	Timescale              int          `xml:"timescale,attr"`
+	Initialization         string       `xml:"initialization,attr"`
+	Media                  string       `xml:"media,attr"`
+	StartNumber            int          `xml:"startNumber,attr"`
+	PresentationTimeOffset int64        `xml:"presentationTimeOffset,attr,omitempty"`
+	Timeline               []mpdSegment `xml:"SegmentTimeline>S"`
+}
+
+type mpdSegment struct {
+	T *int64 `xml:"t,attr,omitempty"`
+	D int64  `xml:"d,attr"`
+	R int    `xml:"r,attr,omitempty"`
+}
+
+// Serve the streams as an MPEG-DASH manifest. Every stream is one
+// representation addressed with a segment template, so the chunks
+// and init segments are the same files as for HLS. Only streams with
+// fMP4 chunks can be listed; subtitles are not included.
+func (m *Manager) ServeManifest(w http.ResponseWriter, r *http.Request) error {
+	query := GetQueryString(r)
+	client := m.getClient()
+
+	// One adaptation set per video codec, since
+	// players cannot switch codecs within a set
+	video := make(map[string][]*Stream)
+	for _, stream := range m.clientStreams(client) {
+		if stream.fmp4() {
+			codec := stream.videoCodec()
+			video[codec] = append(video[codec], stream)
+		}
+	}
+
+	audio := make(map[string][]*Stream)
+	for _, stream := range m.streams {
+		if stream.audio == nil || !stream.fmp4() {
+			continue
+		}
+
+		if !stream.audioCopy || client.AudioCodecs[stream.audio.CodecName] {
+			// One set per track and codec
+			key := fmt.Sprintf("%03d-%s", stream.audio.Index, stream.audioCodecString())
+			audio[key] = append(audio[key], stream)
+		}
+	}
+
+	if len(video) == 0 {
+		// Chunks are MPEG-TS (e.g. fMP4 is disabled)
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	period := mpdPeriod{ID: "0", Sets: make([]*mpdAdaptationSet, 0)}
+
+	for _, codec := range append([]string{CODEC_H264}, variantCodecs...) {
+		streams := video[codec]
+		if len(streams) == 0 {
+			continue
+		}
+		sortStreams(streams)
+
+		set := &mpdAdaptationSet{
+			ID:               len(period.Sets),
+			ContentType:      "video",
+			MimeType:         "video/mp4",
+			SegmentAlignment: true,
+			StartWithSAP:     1,
+		}
+
+		// Chunks of the remuxed stream follow the
+		// keyframes of the source instead
+		for _, stream := range streams {
+			if stream.encoder.Codec() == ENCODER_COPY {
+				set.SegmentAlignment = false
+			}
+
+			set.Representations = append(set.Representations, &mpdRepresentation{
+				ID:              stream.quality,
+				Bandwidth:       stream.bitrate,
+				Codecs:          stream.encoder.Profile(stream).String(),
+				Width:           stream.width,
+				Height:          stream.height,
+				FrameRate:       m.probe.FrameRate,
+				SegmentTemplate: stream.dashSegmentTemplate(query),
+			})
+		}
+
+		period.Sets = append(period.Sets, set)
+	}
+
+	// Audio sets in the order of the tracks
+	keys := make([]string, 0)
+	for key := range audio {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		streams := audio[key]
+		sortStreams(streams)
+		track := streams[0].audio
+
+		set := &mpdAdaptationSet{
+			ID:               len(period.Sets),
+			ContentType:      "audio",
+			MimeType:         "audio/mp4",
+			SegmentAlignment: true,
+			StartWithSAP:     1,
+		}
+
+		if lang := track.Language; lang != "" && lang != "und" {
+			set.Lang = lang
+		}
+
+		if track.Default {
+			set.Role = &mpdDescriptor{SchemeIdUri: "urn:mpeg:dash:role:2011", Value: "main"}
+		}
+
+		for _, stream := range streams {
+			set.Representations = append(set.Representations, &mpdRepresentation{
+				ID:        stream.quality,
+				Bandwidth: stream.bitrate,
+				Codecs:    stream.audioCodecString(),
+				AudioChannelConfiguration: &mpdDescriptor{
+					SchemeIdUri: "urn:mpeg:dash:23003:3:audio_channel_configuration:2011",
+					Value:       fmt.Sprintf("%d", stream.audioChannels()),
+				},
+				SegmentTemplate: stream.dashSegmentTemplate(query),
+			})
+		}
+
+		period.Sets = append(period.Sets, set)
+	}
+
+	manifest := &mpd{
+		Xmlns:                     "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:                  "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:                      "static",
+		MediaPresentationDuration: fmt.Sprintf("PT%.3fS", m.probe.Duration.Seconds()),
+		MinBufferTime:             fmt.Sprintf("PT%dS", m.c.ChunkSize),
+		Period:                    period,
+	}
+
+	out, err := xml.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/dash+xml")
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+	return nil
+}
+
+// Segment template addressing the chunks of this stream. The durations
+// are those of the HLS playlist; runs of equal length are merged.
+func (s *Stream) dashSegmentTemplate(query string) mpdSegmentTemplate {
+	t := mpdSegmentTemplate{
+		Timescale:      DASH_TIMESCALE,
+		Initialization: fmt.Sprintf("$RepresentationID$-init.mp4%s", query),
+		Media:          fmt.Sprintf("$RepresentationID$-$Number%%06d$.mp4%s", query),
+		StartNumber:    0,
+		Timeline:       make([]mpdSegment, 0),
+	}
+
+	// Timestamps of the source are kept (-copyts), so the media
+	// starts at the start time of the source instead of zero
+	offset := s.m.probe.StartTime
+	t.PresentationTimeOffset = int64(math.Round(offset * DASH_TIMESCALE))
+	for i := range s.segments {
+		start := int64(math.Round((s.segments[i] + offset) * DASH_TIMESCALE))
+		end := int64(math.Round((s.chunkEnd(i) + offset) * DASH_TIMESCALE))
+
+		if n := len(t.Timeline); n > 0 && t.Timeline[n-1].D == end-start {
+			t.Timeline[n-1].R++
+			continue
+		}
+
+		seg := mpdSegment{D: end - start}
+		if i == 0 {
+			seg.T = &start
+		}
+		t.Timeline = append(t.Timeline, seg)
+	}
+
+	return t
+}
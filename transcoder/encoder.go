@@ -0,0 +1,132 @@
+package transcoder
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+)
+
+// Number of chunk boundaries that a coder forces keyframes at.
+// All of them are passed on the command line, which is limited
+// in length, so a coder stops after this many chunks.
+const KEYFRAME_WINDOW = 500
+
+// Encoder is a video encoding backend for ffmpeg.
+// Implementations register themselves with RegisterEncoder in init().
+type Encoder interface {
+	// Name of the ffmpeg video codec (the value of -c:v)
+	Codec() string
+
+	// Arguments placed before the input (e.g. hwaccel setup)
+	InputArgs(s *Stream) []string
+
+	// Filter chain that scales to the size of the stream.
+	// Empty if the encoder does not take filters.
+	Filter(s *Stream) string
+
+	// Codec specific output arguments (quality, rate control, profile)
+	OutputArgs(s *Stream) []string
+
+	// Codec profile and level of the output
+	Profile(s *Stream) *CodecProfile
+
+	// Arguments that put keyframes at chunk boundaries, for a
+	// coder starting at the given chunk
+	KeyframeArgs(s *Stream, startId int) []string
+
+	// Name of the filter used for the transpose workaround.
+	// Empty if transposing is not supported by this backend.
+	Transposer(s *Stream) string
+}
+
+var encoders = make(map[string]Encoder)
+
+// RegisterEncoder makes an encoder available by its codec name.
+func RegisterEncoder(e Encoder) {
+	encoders[e.Codec()] = e
+}
+
+// GetEncoder returns the encoder registered for the codec name,
+// or nil if there is no such encoder.
+func GetEncoder(codec string) Encoder {
+	return encoders[codec]
+}
+
+// Get the encoder to use for new streams from the configuration,
+// falling back to software encoding if the name is unknown.
+func (c *Config) DefaultEncoder() Encoder {
+	name := c.Encoder
+	if name == "" {
+		if c.VAAPI {
+			name = ENCODER_VAAPI
+		} else if c.NVENC {
+			name = ENCODER_NVENC
+		} else if c.QSV {
+			name = ENCODER_QSV
+		} else {
+			name = ENCODER_X264
+		}
+	}
+
+	if e := GetEncoder(name); e != nil {
+		return c.healthyEncoder(e)
+	}
+
+	slog.Warn("unknown encoder, falling back", "encoder", name, "fallback", ENCODER_X264)
+	return GetEncoder(ENCODER_X264)
+}
+
+// Build a scaling filter chain. The format filter is applied first,
+// then the scaler with the given extra arguments and the stream size.
+func scaleFilter(s *Stream, format string, scaler string, scalerArgs ...string) string {
+	// Scale height and width if not max quality
+	if s.quality != QUALITY_MAX {
+		// Proper aspect ratio scaling - avoid creating squares!
+		scalerArgs = append(scalerArgs, fmt.Sprintf("w=%d", s.width))
+		scalerArgs = append(scalerArgs, fmt.Sprintf("h=%d", s.height))
+	}
+
+	if len(scalerArgs) == 0 {
+		return fmt.Sprintf("%s,%s", format, scaler)
+	}
+	return fmt.Sprintf("%s,%s=%s", format, scaler, strings.Join(scalerArgs, ":"))
+}
+
+// Keyframe arguments shared by all encoders that re-encode
+func forceKeyframeArgs(s *Stream, startId int) []string {
+	if s.c.UseGopSize && s.m.probe.FrameRate > 0 {
+		// Fix GOP size
+		return []string{
+			"-g", fmt.Sprintf("%d", s.c.ChunkSize*s.m.probe.FrameRate),
+			"-keyint_min", fmt.Sprintf("%d", s.c.ChunkSize*s.m.probe.FrameRate),
+		}
+	}
+
+	// Force keyframes exactly at the chunk boundaries. The output
+	// keeps the timestamps of the source (-copyts), which include
+	// its start time.
+	startId = min(startId, len(s.segments))
+	endId := min(startId+KEYFRAME_WINDOW, len(s.segments))
+	times := make([]string, 0, endId-startId)
+	for _, t := range s.segments[startId:endId] {
+		times = append(times, fmt.Sprintf("%.6f", t+s.m.probe.StartTime))
+	}
+	args := []string{"-force_key_frames", strings.Join(times, ",")}
+
+	// Past the window the encoder would place keyframes anywhere,
+	// so stop there. The next request starts a new coder.
+	if endId < len(s.segments) {
+		args = append(args, []string{"-to", fmt.Sprintf("%.6f", s.chunkStart(endId)+s.m.probe.StartTime)}...)
+	}
+
+	// No other keyframes may be placed by the encoder, since the
+	// muxer would start a new chunk on those. Chunks are at most
+	// this long, so double the GOP size is always enough.
+	if s.m.probe.FrameRate > 0 {
+		gop := int(math.Ceil(s.maxChunkDuration()*float64(s.m.probe.FrameRate))) * 2
+		args = append(args, []string{"-g", fmt.Sprintf("%d", gop)}...)
+	}
+
+	return args
+}
@@ -0,0 +1,41 @@
+package transcoder
+
+// Passthrough of the source video stream without re-encoding
+type copyEncoder struct{}
+
+func init() {
+	RegisterEncoder(&copyEncoder{})
+}
+
+func (e *copyEncoder) Codec() string {
+	return ENCODER_COPY
+}
+
+func (e *copyEncoder) InputArgs(s *Stream) []string {
+	return []string{}
+}
+
+func (e *copyEncoder) Filter(s *Stream) string {
+	return ""
+}
+
+func (e *copyEncoder) OutputArgs(s *Stream) []string {
+	// Safari only plays HEVC in fMP4 with the hvc1 tag
+	if s.m.probe.CodecName == CODEC_HEVC {
+		return []string{"-tag:v", "hvc1"}
+	}
+	return []string{}
+}
+
+func (e *copyEncoder) Profile(s *Stream) *CodecProfile {
+	return sourceProfile(s)
+}
+
+func (e *copyEncoder) KeyframeArgs(s *Stream, startId int) []string {
+	// Keyframes of the source are used as-is
+	return []string{}
+}
+
+func (e *copyEncoder) Transposer(s *Stream) string {
+	return ""
+}
@@ -0,0 +1,165 @@
+package transcoder
+
+import "fmt"
+
+// Hardware H.264 and HEVC encoding with NVIDIA NVENC
+type nvencEncoder struct {
+	codec string
+}
+
+func init() {
+	RegisterEncoder(&nvencEncoder{codec: ENCODER_NVENC})
+	RegisterEncoder(&nvencEncoder{codec: ENCODER_NVENC_HEVC})
+}
+
+func (e *nvencEncoder) Codec() string {
+	return e.codec
+}
+
+func (e *nvencEncoder) InputArgs(s *Stream) []string {
+	// Enhanced CUDA acceleration with device selection
+	// Don't use hwaccel_output_format cuda - it causes filter chain issues
+	// Let frames stay in system memory and use hwupload_cuda in the filter
+	return []string{
+		"-hwaccel", "cuda",
+		"-hwaccel_device", fmt.Sprintf("%d", s.c.CUDADevice),
+	}
+}
+
+func (e *nvencEncoder) Filter(s *Stream) string {
+	// Use NPP for better performance (your FFmpeg supports it)
+	format := "format=nv12,hwupload_cuda"
+
+	// Use appropriate scaler based on NVENCScale setting
+	if s.c.NVENCScale == "npp" {
+		return scaleFilter(s, format, "scale_npp", "force_original_aspect_ratio=decrease")
+	} else if s.c.NVENCScale == "cuda" {
+		// workaround to force scale_cuda to examine all input frames
+		return scaleFilter(s, format, "scale_cuda", "force_original_aspect_ratio=decrease", "passthrough=0")
+	}
+
+	// fallback to basic scale
+	return scaleFilter(s, format, "scale", "force_original_aspect_ratio=decrease")
+}
+
+func (e *nvencEncoder) OutputArgs(s *Stream) []string {
+	// Adaptive encoding complexity based on content and hardware
+	preset := "p4"  // Default balanced preset
+	tune := "hq"    // Default high quality
+	lookahead := 60 // Default lookahead
+
+	// Adjust based on content complexity and adaptive settings
+	if s.c.AdaptiveComplexity {
+		// Special handling for very demanding content
+		if s.m.probe.BitRate > 100000000 { // >100Mbps: extremely high complexity
+			preset = "p2"   // Slowest preset for demanding content
+			lookahead = 250 // Maximum lookahead for best prediction
+			tune = "hq"     // High quality mode
+		} else if s.m.probe.BitRate > 50000000 { // >50Mbps: very high complexity
+			preset = "p3"   // Slower preset for high bitrate
+			lookahead = 120 // Extended lookahead
+		} else if s.m.probe.BitRate > 20000000 { // >20Mbps: high complexity
+			preset = "p4" // Balanced for moderate high bitrate
+			lookahead = 80
+		}
+
+		// Special handling for high framerate content (>30fps)
+		if s.m.probe.FrameRate > 30 {
+			lookahead = int(float64(lookahead) * 1.5) // Increase lookahead for HFR
+			if s.m.probe.FrameRate >= 50 {            // 50fps+ (like deinterlaced content)
+				preset = "p3" // Use slower preset for very high framerate
+				if lookahead > 250 {
+					lookahead = 250 // Cap at maximum
+				}
+			}
+		}
+
+		// For lower qualities, prioritize speed but not at expense of stability
+		if s.quality == "480p" {
+			if s.m.probe.BitRate > 50000000 {
+				preset = "p5" // Don't go too fast for complex content
+				lookahead = 40
+			} else {
+				preset = "p7" // Fastest for simple low quality
+				tune = "ll"   // Low latency
+				lookahead = 20
+			}
+		} else if s.quality == "720p" {
+			if s.m.probe.BitRate > 50000000 {
+				preset = "p4" // Slower for complex 720p
+				lookahead = 60
+			} else {
+				preset = "p6"
+				lookahead = 30
+			}
+		}
+	}
+
+	// GPU-specific optimizations
+	args := []string{
+		"-gpu", fmt.Sprintf("%d", s.c.CUDADevice),
+		"-preset", preset,
+		"-tune", tune,
+		"-rc", "vbr",
+		"-rc-lookahead", fmt.Sprintf("%d", lookahead),
+		"-multipass", "fullres", // Better quality for demanding content
+		"-cq", fmt.Sprintf("%d", s.c.QF),
+	}
+
+	// Advanced NVENC features
+	if s.c.NVENCTemporalAQ {
+		args = append(args, []string{"-temporal-aq", "1"}...)
+	}
+
+	// GPU memory management (removed incompatible option)
+	// Note: -gpu_memory_limit not supported in all FFmpeg versions
+
+	// Add rate control aligned with advertised bandwidth
+	// This prevents encoder overshoot that causes rebuffering
+	if s.quality != QUALITY_MAX {
+		target := s.bitrate
+		maxrate := int(float64(target) * 1.25) // Allow 25% burst
+		bufsize := maxrate * 2                 // 2 second buffer
+		args = append(args, []string{
+			"-maxrate", fmt.Sprintf("%d", maxrate),
+			"-bufsize", fmt.Sprintf("%d", bufsize),
+		}...)
+	}
+
+	// Safari only plays HEVC in fMP4 with the hvc1 tag
+	if e.codec == ENCODER_NVENC_HEVC {
+		args = append(args, []string{"-tag:v", "hvc1"}...)
+	}
+
+	return append(args, profileArgs(e.Profile(s))...)
+}
+
+func (e *nvencEncoder) Profile(s *Stream) *CodecProfile {
+	if e.codec == ENCODER_NVENC_HEVC {
+		return hevcProfile(s)
+	}
+	return h264Profile(s)
+}
+
+func (e *nvencEncoder) KeyframeArgs(s *Stream, startId int) []string {
+	args := forceKeyframeArgs(s, startId)
+
+	// For NVENC, add extra options to handle complex edited content.
+	// Same condition as forcing keyframes in forceKeyframeArgs.
+	if !(s.c.UseGopSize && s.m.probe.FrameRate > 0) {
+		args = append(args, []string{
+			"-forced-idr", "1", // Force IDR frames for better seeking
+			"-no-scenecut", "1", // No keyframes on scene changes
+		}...)
+	}
+
+	return args
+}
+
+func (e *nvencEncoder) Transposer(s *Stream) string {
+	// transpose_cuda does not exist
+	if s.c.NVENCScale == "npp" {
+		return "transpose_npp"
+	}
+	return ""
+}
@@ -0,0 +1,49 @@
+package transcoder
+
+import "fmt"
+
+// Hardware H.264 encoding with Intel Quick Sync Video
+type qsvEncoder struct{}
+
+func init() {
+	RegisterEncoder(&qsvEncoder{})
+}
+
+func (e *qsvEncoder) Codec() string {
+	return ENCODER_QSV
+}
+
+func (e *qsvEncoder) InputArgs(s *Stream) []string {
+	return []string{
+		"-init_hw_device", "qsv=hw",
+		"-filter_hw_device", "hw",
+	}
+}
+
+func (e *qsvEncoder) Filter(s *Stream) string {
+	// scale_qsv does not know about force_original_aspect_ratio,
+	// but the stream size already has the right aspect ratio
+	return scaleFilter(s, "format=nv12,hwupload=extra_hw_frames=64", "scale_qsv")
+}
+
+func (e *qsvEncoder) OutputArgs(s *Stream) []string {
+	args := []string{
+		"-preset", "faster",
+		"-global_quality", fmt.Sprintf("%d", s.c.QF),
+	}
+
+	return append(args, profileArgs(e.Profile(s))...)
+}
+
+func (e *qsvEncoder) Profile(s *Stream) *CodecProfile {
+	return h264Profile(s)
+}
+
+func (e *qsvEncoder) KeyframeArgs(s *Stream, startId int) []string {
+	return forceKeyframeArgs(s, startId)
+}
+
+func (e *qsvEncoder) Transposer(s *Stream) string {
+	// Transposing needs vpp_qsv, which has a different syntax
+	return ""
+}
@@ -0,0 +1,44 @@
+package transcoder
+
+import "fmt"
+
+// Software AV1 encoding with SVT-AV1
+type svtav1Encoder struct{}
+
+func init() {
+	RegisterEncoder(&svtav1Encoder{})
+}
+
+func (e *svtav1Encoder) Codec() string {
+	return ENCODER_SVTAV1
+}
+
+func (e *svtav1Encoder) InputArgs(s *Stream) []string {
+	return []string{}
+}
+
+func (e *svtav1Encoder) Filter(s *Stream) string {
+	return scaleFilter(s, "format=yuv420p", "scale", "force_original_aspect_ratio=decrease")
+}
+
+func (e *svtav1Encoder) OutputArgs(s *Stream) []string {
+	// SVT-AV1 picks the level by itself and the profile
+	// options differ between ffmpeg versions, so these are
+	// only used for the CODECS attribute.
+	return []string{
+		"-preset", "8",
+		"-crf", fmt.Sprintf("%d", s.c.QF),
+	}
+}
+
+func (e *svtav1Encoder) Profile(s *Stream) *CodecProfile {
+	return av1Profile(s)
+}
+
+func (e *svtav1Encoder) KeyframeArgs(s *Stream, startId int) []string {
+	return forceKeyframeArgs(s, startId)
+}
+
+func (e *svtav1Encoder) Transposer(s *Stream) string {
+	return "transpose"
+}
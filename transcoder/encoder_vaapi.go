@@ -0,0 +1,60 @@
+package transcoder
+
+import "fmt"
+
+// Hardware H.264 and HEVC encoding with VA-API
+type vaapiEncoder struct {
+	codec string
+}
+
+func init() {
+	RegisterEncoder(&vaapiEncoder{codec: ENCODER_VAAPI})
+	RegisterEncoder(&vaapiEncoder{codec: ENCODER_VAAPI_HEVC})
+}
+
+func (e *vaapiEncoder) Codec() string {
+	return e.codec
+}
+
+func (e *vaapiEncoder) InputArgs(s *Stream) []string {
+	return []string{
+		"-hwaccel", "vaapi",
+		"-hwaccel_device", "/dev/dri/renderD128",
+		"-hwaccel_output_format", "vaapi",
+	}
+}
+
+func (e *vaapiEncoder) Filter(s *Stream) string {
+	return scaleFilter(s, "format=nv12|vaapi,hwupload", "scale_vaapi",
+		"force_original_aspect_ratio=decrease", "format=nv12")
+}
+
+func (e *vaapiEncoder) OutputArgs(s *Stream) []string {
+	args := []string{"-global_quality", fmt.Sprintf("%d", s.c.QF)}
+
+	if s.c.VAAPILowPower {
+		args = append(args, []string{"-low_power", "1"}...)
+	}
+
+	// Safari only plays HEVC in fMP4 with the hvc1 tag
+	if e.codec == ENCODER_VAAPI_HEVC {
+		args = append(args, []string{"-tag:v", "hvc1"}...)
+	}
+
+	return append(args, profileArgs(e.Profile(s))...)
+}
+
+func (e *vaapiEncoder) Profile(s *Stream) *CodecProfile {
+	if e.codec == ENCODER_VAAPI_HEVC {
+		return hevcProfile(s)
+	}
+	return h264Profile(s)
+}
+
+func (e *vaapiEncoder) KeyframeArgs(s *Stream, startId int) []string {
+	return forceKeyframeArgs(s, startId)
+}
+
+func (e *vaapiEncoder) Transposer(s *Stream) string {
+	return "transpose_vaapi"
+}
@@ -0,0 +1,44 @@
+package transcoder
+
+import "fmt"
+
+// Software H.264 encoding with libx264
+type x264Encoder struct{}
+
+func init() {
+	RegisterEncoder(&x264Encoder{})
+}
+
+func (e *x264Encoder) Codec() string {
+	return ENCODER_X264
+}
+
+func (e *x264Encoder) InputArgs(s *Stream) []string {
+	return []string{}
+}
+
+func (e *x264Encoder) Filter(s *Stream) string {
+	return scaleFilter(s, "format=nv12", "scale", "force_original_aspect_ratio=decrease")
+}
+
+func (e *x264Encoder) OutputArgs(s *Stream) []string {
+	args := []string{
+		"-preset", "faster",
+		"-crf", fmt.Sprintf("%d", s.c.QF),
+	}
+
+	return append(args, profileArgs(e.Profile(s))...)
+}
+
+func (e *x264Encoder) Profile(s *Stream) *CodecProfile {
+	return h264Profile(s)
+}
+
+func (e *x264Encoder) KeyframeArgs(s *Stream, startId int) []string {
+	// No keyframes on scene changes
+	return append(forceKeyframeArgs(s, startId), "-sc_threshold", "0")
+}
+
+func (e *x264Encoder) Transposer(s *Stream) string {
+	return "transpose"
+}
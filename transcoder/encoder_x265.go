@@ -0,0 +1,55 @@
+package transcoder
+
+import "fmt"
+
+// Software HEVC encoding with libx265
+type x265Encoder struct{}
+
+func init() {
+	RegisterEncoder(&x265Encoder{})
+}
+
+func (e *x265Encoder) Codec() string {
+	return ENCODER_X265
+}
+
+func (e *x265Encoder) InputArgs(s *Stream) []string {
+	return []string{}
+}
+
+func (e *x265Encoder) Filter(s *Stream) string {
+	// libx265 does not take nv12
+	return scaleFilter(s, "format=yuv420p", "scale", "force_original_aspect_ratio=decrease")
+}
+
+func (e *x265Encoder) OutputArgs(s *Stream) []string {
+	p := e.Profile(s)
+
+	// The level and the GOP structure can only be set with
+	// x265-params. Open GOPs and scene cuts would put keyframes
+	// where the muxer does not expect them.
+	params := fmt.Sprintf("level-idc=%d:open-gop=0:scenecut=0:log-level=warning", p.Level)
+
+	return []string{
+		"-preset", "faster",
+		"-crf", fmt.Sprintf("%d", s.c.QF),
+		"-profile:v", p.Profile,
+		"-x265-params", params,
+
+		// Safari only plays HEVC in fMP4 with the hvc1 tag
+		"-tag:v", "hvc1",
+	}
+}
+
+func (e *x265Encoder) Profile(s *Stream) *CodecProfile {
+	return hevcProfile(s)
+}
+
+func (e *x265Encoder) KeyframeArgs(s *Stream, startId int) []string {
+	// Forced keyframes must be IDR frames to start a chunk
+	return append(forceKeyframeArgs(s, startId), "-forced-idr", "1")
+}
+
+func (e *x265Encoder) Transposer(s *Stream) string {
+	return "transpose"
+}
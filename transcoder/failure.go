@@ -0,0 +1,141 @@
+package transcoder
+
+import (
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Reasons of failed chunk requests
+const (
+	FAILURE_UNSUPPORTED_CODEC = "unsupported_codec"
+	FAILURE_HWACCEL           = "hwaccel"
+	FAILURE_MISSING_INPUT     = "missing_input"
+	FAILURE_NO_SPACE          = "no_space"
+	FAILURE_UNKNOWN           = "unknown"
+	FAILURE_TIMEOUT           = "timeout"   // 408, ffmpeg is still running
+	FAILURE_RESTARTED         = "restarted" // 409, the coder was replaced
+)
+
+// Known ffmpeg messages of each reason, lowercase.
+// The first reason with a match in the stderr wins.
+var failurePatterns = []struct {
+	reason   string
+	patterns []string
+}{
+	{FAILURE_NO_SPACE, []string{
+		"no space left on device",
+		"disk quota exceeded",
+	}},
+	{FAILURE_HWACCEL, []string{
+		"failed to initialise vaapi",
+		"no va display found",
+		"device creation failed",
+		"cannot load libcuda",
+		"openencodesessionex failed",
+		"no capable devices found",
+		"no nvenc capable devices found",
+		"failed to create a cuda device",
+		"error initializing a mfx session",
+		"hardware device setup failed",
+	}},
+	{FAILURE_UNSUPPORTED_CODEC, []string{
+		"unknown encoder",
+		"unknown decoder",
+		"encoder not found",
+		"decoder not found",
+		"codec not currently supported",
+		"unsupported codec",
+		"could not find codec parameters",
+		"not supported by the bitstream filter",
+	}},
+	{FAILURE_MISSING_INPUT, []string{
+		"no such file or directory",
+		"invalid data found when processing input",
+		"does not contain any stream",
+		"permission denied",
+	}},
+}
+
+// Diagnostics of a failed ffmpeg process
+type Failure struct {
+	Reason  string    `json:"reason"`
+	Message string    `json:"message"` // stderr line that matched
+	Status  int       `json:"status"`  // exit status of ffmpeg
+	Time    time.Time `json:"time"`
+	Stderr  []string  `json:"stderr"` // last lines of stderr
+
+	// Encoder that the stream fell back to after this failure
+	Fallback string `json:"fallback,omitempty"`
+	// Failure that caused the fallback to the encoder that failed now
+	Previous *Failure `json:"previous,omitempty"`
+
+	coder *exec.Cmd
+}
+
+// Classify the failure of the coder from its stderr
+func newFailure(coder *exec.Cmd, status int, stderr []string) *Failure {
+	f := &Failure{
+		Reason: FAILURE_UNKNOWN,
+		Status: status,
+		Time:   time.Now(),
+		Stderr: append([]string{}, stderr...),
+		coder:  coder,
+	}
+
+	for _, fp := range failurePatterns {
+		for _, line := range stderr {
+			l := strings.ToLower(line)
+			for _, p := range fp.patterns {
+				if strings.Contains(l, p) {
+					f.Reason = fp.reason
+					f.Message = line
+					return f
+				}
+			}
+		}
+	}
+
+	// The last line is usually the most useful
+	if len(stderr) > 0 {
+		f.Message = stderr[len(stderr)-1]
+	}
+	return f
+}
+
+// Write an error response for a chunk request. The failure
+// of the coder is included if there is one.
+func writeChunkError(w http.ResponseWriter, status int, reason string, f *Failure) {
+	body := struct {
+		Reason  string   `json:"reason"`
+		Failure *Failure `json:"failure,omitempty"`
+	}{reason, f}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// Check if the current coder exited with a failure.
+// Must be called with lock held.
+func (s *Stream) coderFailed() bool {
+	return s.coder != nil && s.failure != nil && s.failure.coder == s.coder
+}
+
+// Serve the last failure of ffmpeg for this stream,
+// or No Content if transcoding never failed
+func (s *Stream) ServeError(w http.ResponseWriter) error {
+	s.mutex.Lock()
+	f := s.failure
+	s.mutex.Unlock()
+
+	if f == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(f)
+}
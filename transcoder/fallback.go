@@ -0,0 +1,165 @@
+package transcoder
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Time a hardware encoder is not used after it failed to start
+const ENCODER_COOLDOWN = 5 * time.Minute
+
+// Encoders to fall back to for each codec, in order.
+// Software encoding at the end always works.
+var encoderFallbacks = [][]string{
+	{ENCODER_NVENC, ENCODER_VAAPI, ENCODER_QSV, ENCODER_X264},
+	{ENCODER_NVENC_HEVC, ENCODER_VAAPI_HEVC, ENCODER_X265},
+}
+
+// Hardware encoders that failed, by codec name. Shared by all
+// managers since they run on the same hardware.
+var encoderHealth = struct {
+	sync.Mutex
+	failed map[string]time.Time
+}{failed: make(map[string]time.Time)}
+
+func isHardwareEncoder(name string) bool {
+	return strings.HasSuffix(name, "_nvenc") || strings.HasSuffix(name, "_vaapi") || strings.HasSuffix(name, "_qsv")
+}
+
+// Mark the encoder as unhealthy for ENCODER_COOLDOWN
+func markEncoderFailed(name string) {
+	encoderHealth.Lock()
+	defer encoderHealth.Unlock()
+	encoderHealth.failed[name] = time.Now()
+}
+
+// Check if the encoder did not fail recently
+func encoderHealthy(name string) bool {
+	encoderHealth.Lock()
+	defer encoderHealth.Unlock()
+
+	t, ok := encoderHealth.failed[name]
+	if ok && time.Since(t) > ENCODER_COOLDOWN {
+		delete(encoderHealth.failed, name)
+		return true
+	}
+	return !ok
+}
+
+// Check if the hardware of the encoder is enabled in the configuration
+func (c *Config) hardwareEnabled(name string) bool {
+	switch {
+	case name == c.Encoder:
+		return true
+	case strings.HasSuffix(name, "_nvenc"):
+		return c.NVENC
+	case strings.HasSuffix(name, "_vaapi"):
+		return c.VAAPI
+	case strings.HasSuffix(name, "_qsv"):
+		return c.QSV
+	}
+	return false
+}
+
+// Get the encoder to use instead of the given one: the next encoder
+// of its chain that is enabled and healthy. Returns nil if the
+// encoder has no fallback.
+func (c *Config) FallbackEncoder(e Encoder) Encoder {
+	for _, chain := range encoderFallbacks {
+		found := false
+		for _, name := range chain {
+			if name == e.Codec() {
+				found = true
+				continue
+			}
+			if !found {
+				continue
+			}
+
+			if !isHardwareEncoder(name) || (c.hardwareEnabled(name) && encoderHealthy(name)) {
+				if next := GetEncoder(name); next != nil {
+					return next
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Use the fallback of the encoder if it failed recently
+func (c *Config) healthyEncoder(e Encoder) Encoder {
+	if e == nil || encoderHealthy(e.Codec()) {
+		return e
+	}
+	if next := c.FallbackEncoder(e); next != nil {
+		return next
+	}
+	return e
+}
+
+// Switch to the next encoder if the hardware encoder of the failed
+// coder could not be used, and transcode again from the first chunk
+// that players are waiting for, so that they get it from the new
+// encoder. Returns false if there is nothing to fall back to.
+// Must be called with lock held.
+func (s *Stream) fallback() bool {
+	if s.audio != nil || !isHardwareEncoder(s.encoder.Codec()) {
+		return false
+	}
+
+	// Other failures are about the source or the host, and would
+	// fail the same way with any encoder
+	if s.failure.Reason != FAILURE_HWACCEL {
+		return false
+	}
+
+	next := s.c.FallbackEncoder(s.encoder)
+	if next == nil {
+		return false
+	}
+
+	s.logger().Warn("falling back to another encoder", "encoder", s.encoder.Codec(),
+		"fallback", next.Codec(), "reason", s.failure.Reason, "cooldown", ENCODER_COOLDOWN)
+	markEncoderFailed(s.encoder.Codec())
+	s.encoder = next
+	s.cacheBase = ""
+
+	// The chunks and init segment of the old encoder cannot be mixed
+	// with those of the new one in fMP4. Chunks being waited for are
+	// kept so that the players get them from the new coder.
+	first := -1
+	for id, chunk := range s.chunks {
+		if chunk.done {
+			s.pruneChunk(id)
+		} else if first == -1 || id < first {
+			first = id
+		}
+	}
+	if _, err := os.Stat(s.getInitPath()); err == nil {
+		// A new channel since this one was closed on saving
+		os.Remove(s.getInitPath())
+		s.initReady = nil
+	}
+
+	s.coder = nil
+	if s.coderInit != "" && s.coderInit != s.coderFile {
+		os.Remove(s.coderInit)
+	}
+	s.coderInit = ""
+	s.seenChunks = make(map[int]bool)
+
+	// The failure is kept to explain the fallback, but players
+	// that time out waiting for it get a conflict instead
+	s.failure.Fallback = next.Codec()
+
+	// Nobody is waiting; the next request starts the new encoder
+	if first == -1 {
+		return true
+	}
+
+	s.goal = first + s.c.GoalBufferMax
+	s.transcode(first)
+	return true
+}
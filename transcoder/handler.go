@@ -4,7 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strings"
@@ -16,6 +16,10 @@ type Handler struct {
 	c        *Config
 	server   *http.Server
 	managers map[string]*Manager
+	sched    *Scheduler
+	cache    *SegmentCache
+	storage  *Storage
+	uploads  *Uploads
 	mutex    sync.RWMutex
 	close    chan string
 	exitCode int
@@ -25,6 +29,9 @@ func NewHandler(c *Config) *Handler {
 	h := &Handler{
 		c:        c,
 		managers: make(map[string]*Manager),
+		sched:    NewScheduler(c),
+		cache:    NewSegmentCache(c),
+		storage:  NewStorage(c),
 		close:    make(chan string),
 		exitCode: 0,
 	}
@@ -33,19 +40,18 @@ func NewHandler(c *Config) *Handler {
 	os.RemoveAll(c.TempDir)
 	os.MkdirAll(c.TempDir, 0755)
 
+	h.uploads = NewUploads(c, h.storage)
+
+	// Keyframe indexes of files that were changed meanwhile
+	go pruneKeyframes(c)
 	return h
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Check version if monitoring is enabled
-	if h.c.VersionMonitor && !h.versionOk(w, r) {
-		return
-	}
-
 	url := r.URL.Path
 	parts := make([]string, 0)
 
-	// log.Println("Serving", url)
+	slog.Debug("serving", "url", url)
 
 	// Break url into parts
 	for _, part := range strings.Split(url, "/") {
@@ -54,9 +60,31 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Prometheus metrics
+	if url == "/metrics" {
+		if !h.hasAdminToken(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h.ServeMetrics(w, r)
+		return
+	}
+
+	// Status and control of the managers
+	if len(parts) > 0 && parts[0] == "admin" {
+		if !h.hasAdminToken(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h.ServeAdmin(w, r, parts[1:])
+		return
+	}
+
 	// Serve actual file from manager
 	if len(parts) < 3 {
-		log.Println("Invalid URL", url)
+		slog.Warn("invalid URL", "url", url)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -66,6 +94,26 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	path := "/" + strings.Join(parts[1:len(parts)-1], "/")
 	chunk := parts[len(parts)-1]
 
+	// Uploads and configuration need the admin token,
+	// everything else a signature for the stream
+	admin := parts[1] == "upload" || (r.Method == "POST" && (parts[1] == "create" || chunk == "config"))
+	if admin && !h.isAdmin(r) {
+		slog.Warn("unauthorized admin request", "url", url)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if !admin && !h.authorized(r, streamid, path) {
+		slog.Warn("invalid signature", "url", url)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// Check version if monitoring is enabled. This stops the
+	// server, so only authorized requests may do it.
+	if h.c.VersionMonitor && !h.versionOk(w, r) {
+		return
+	}
+
 	// Check if POST request to create temp file
 	if r.Method == "POST" && len(parts) >= 2 && parts[1] == "create" {
 		var err error
@@ -75,8 +123,19 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Resumable upload of a temp file
+	if parts[1] == "upload" {
+		h.uploads.ServeHTTP(w, r, streamid, parts[2])
+		return
+	}
+
 	// Check if test request
 	if chunk == "test" {
+		var ok bool
+		if path, ok = h.checkPath(w, path, true); !ok {
+			return
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 
 		// check if test file is readable
@@ -99,23 +158,24 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// read new config
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			log.Println("Error reading body", err)
+			slog.Error("could not read config", "err", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
 		// Unmarshal config
 		if err := json.Unmarshal(body, h.c); err != nil {
-			log.Println("Error unmarshaling config", err)
+			slog.Error("could not parse config", "err", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
 		// Set config as loaded
 		h.c.Configured = true
+		SetupLogging(h.c)
 
 		// Print loaded config
-		log.Printf("%+v\n", h.c)
+		h.c.Print()
 		return
 	}
 
@@ -131,10 +191,22 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Only files that may be read are passed to ffmpeg
+	var ok bool
+	if path, ok = h.checkPath(w, path, false); !ok {
+		return
+	}
+
 	// Get existing manager or create new one
 	manager := h.getManager(path, streamid)
 	if manager == nil {
-		manager = h.createManager(path, streamid)
+		// Refuse new sessions if the temp directory is full
+		if !h.storage.Reclaim(0) {
+			http.Error(w, "Not enough space for transcoding", http.StatusInsufficientStorage)
+			return
+		}
+
+		manager = h.createManager(path, streamid, NewClientProfile(h.c, r))
 	}
 
 	// Failed to create manager
@@ -152,7 +224,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) versionOk(w http.ResponseWriter, r *http.Request) bool {
 	expected := r.Header.Get("X-Go-Vod-Version")
 	if len(expected) > 0 && expected != h.c.Version {
-		log.Println("Version mismatch", expected, h.c.Version)
+		slog.Warn("version mismatch", "expected", expected, "version", h.c.Version)
 
 		// Try again in some time
 		w.WriteHeader(http.StatusServiceUnavailable)
@@ -177,10 +249,10 @@ func (h *Handler) getManager(path string, streamid string) *Manager {
 	return m
 }
 
-func (h *Handler) createManager(path string, streamid string) *Manager {
-	manager, err := NewManager(h.c, path, streamid, h.close)
+func (h *Handler) createManager(path string, streamid string, client *ClientProfile) *Manager {
+	manager, err := NewManager(h.c, path, streamid, h.close, h.sched, h.cache, client)
 	if err != nil {
-		log.Println("Error creating manager", err)
+		slog.Error("could not create manager", "manager", streamid, "path", path, "err", err)
 		freeIfTemp(path)
 		return nil
 	}
@@ -191,31 +263,62 @@ func (h *Handler) createManager(path string, streamid string) *Manager {
 	old := h.managers[streamid]
 	if old != nil {
 		old.Destroy()
+		h.storage.Unregister(old)
 	}
 
 	h.managers[streamid] = manager
+	h.storage.Register(manager)
 	return manager
 }
 
+// Remove the manager and then destroy it, so that it cannot be
+// handed out once destroyed. The files are removed without holding
+// the lock. Does nothing if it was replaced already.
+func (h *Handler) destroyManager(m *Manager) {
+	h.mutex.Lock()
+	if h.managers[m.id] != m {
+		h.mutex.Unlock()
+		return
+	}
+	delete(h.managers, m.id)
+	h.storage.Unregister(m)
+	h.mutex.Unlock()
+
+	m.Destroy()
+}
+
 func (h *Handler) removeManager(streamid string) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
+	if m := h.managers[streamid]; m != nil {
+		h.storage.Unregister(m)
+	}
 	delete(h.managers, streamid)
 }
 
 func (h *Handler) Start() int {
-	log.Println("Starting go-vod " + h.c.Version + " on " + h.c.Bind)
+	slog.Info("starting go-vod", "version", h.c.Version, "bind", h.c.Bind)
+	if h.c.AdminToken == "" {
+		slog.Warn("no admin token configured, /admin and /metrics are disabled")
+	}
 	h.server = &http.Server{Addr: h.c.Bind, Handler: h}
 
 	go func() {
 		err := h.server.ListenAndServe()
 		if err == http.ErrServerClosed {
-			log.Println("HTTP server closed")
+			slog.Info("HTTP server closed")
 		} else if err != nil {
-			log.Fatal("Error starting server: ", err)
+			slog.Error("could not start server", "err", err)
+			os.Exit(1)
 		}
 	}()
 
+	// Enforce the temp directory limits
+	go h.storage.Run()
+
+	// Expire abandoned uploads
+	go h.uploads.Run()
+
 	for {
 		id := <-h.close
 		if id == "" {
@@ -225,7 +328,7 @@ func (h *Handler) Start() int {
 	}
 
 	// Stop server
-	log.Println("Shutting down HTTP server")
+	slog.Info("shutting down HTTP server")
 	ctx, cancel := context.WithDeadline(context.TODO(), time.Now().Add(5*time.Second))
 	defer cancel()
 	h.server.Shutdown(ctx)
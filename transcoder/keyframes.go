@@ -0,0 +1,313 @@
+package transcoder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timestamps (in seconds) of the keyframes of the source video stream,
+// counted from its start time like seeking with -ss
+type KeyframeIndex struct {
+	Keyframes []float64
+	Duration  float64
+
+	// Identity of the source file when the index was built
+	Path    string
+	Size    int64
+	ModTime int64
+}
+
+// Keyframe indexes being built, by cache path
+var keyframeProbes = struct {
+	sync.Mutex
+	running map[string]bool
+}{running: make(map[string]bool)}
+
+// Get the keyframe index of the source from the cache directory, if
+// the source has not changed since it was built. Otherwise the index
+// is built in the background for later sessions, since reading all
+// packets of a long video takes a while, and nil is returned.
+func (m *Manager) loadKeyframes() *KeyframeIndex {
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return nil
+	}
+
+	cachePath := keyframesCachePath(m.c, m.path)
+	if k := readKeyframes(cachePath); k != nil {
+		if k.Path == m.path && k.current(info) {
+			return k
+		}
+
+		// The source was changed
+		os.Remove(cachePath)
+	}
+
+	go m.indexKeyframes(cachePath, info)
+	return nil
+}
+
+// Build the keyframe index of the source and save it to the cache.
+// Does nothing if the index is being built already.
+func (m *Manager) indexKeyframes(cachePath string, info os.FileInfo) {
+	keyframeProbes.Lock()
+	if keyframeProbes.running[cachePath] {
+		keyframeProbes.Unlock()
+		return
+	}
+	keyframeProbes.running[cachePath] = true
+	keyframeProbes.Unlock()
+
+	defer func() {
+		keyframeProbes.Lock()
+		delete(keyframeProbes.running, cachePath)
+		keyframeProbes.Unlock()
+	}()
+
+	k, err := m.ffprobeKeyframes()
+	if err != nil {
+		return
+	}
+	k.Path = m.path
+	k.Size = info.Size()
+	k.ModTime = info.ModTime().UnixNano()
+
+	// Save to cache; failure here is not fatal
+	if content, err := json.Marshal(k); err == nil {
+		os.MkdirAll(m.c.CacheDir, 0755)
+		if err := ioutil.WriteFile(cachePath, content, 0644); err != nil {
+			m.logger().Warn("could not cache keyframes", "err", err)
+			return
+		}
+	}
+
+	m.logger().Info("keyframe index ready", "keyframes", len(k.Keyframes))
+}
+
+// Remove cached keyframe indexes of sources that were
+// changed or removed since the index was built
+func pruneKeyframes(c *Config) {
+	files, _ := filepath.Glob(filepath.Join(c.CacheDir, "keyframes-*.json"))
+
+	removed := 0
+	for _, file := range files {
+		k := readKeyframes(file)
+		if k != nil && filepath.Base(file) == filepath.Base(keyframesCachePath(c, k.Path)) {
+			if info, err := os.Stat(k.Path); err == nil && k.current(info) {
+				continue
+			}
+		}
+
+		os.Remove(file)
+		removed++
+	}
+
+	if removed > 0 {
+		slog.Info("pruned keyframe indexes", "removed", removed)
+	}
+}
+
+// Path of the cached keyframe index of a source file
+func keyframesCachePath(c *Config, path string) string {
+	h := fnv.New64a()
+	h.Write([]byte(path))
+	return fmt.Sprintf("%s/keyframes-%x.json", c.CacheDir, h.Sum64())
+}
+
+// Read a cached keyframe index. Returns nil if it is missing or invalid.
+func readKeyframes(cachePath string) *KeyframeIndex {
+	content, err := ioutil.ReadFile(cachePath)
+	if err != nil {
+		return nil
+	}
+
+	k := &KeyframeIndex{}
+	if err := json.Unmarshal(content, k); err != nil || len(k.Keyframes) == 0 {
+		return nil
+	}
+	return k
+}
+
+// Check if the index was built from the current version of the source
+func (k *KeyframeIndex) current(info os.FileInfo) bool {
+	return k.Size == info.Size() && k.ModTime == info.ModTime().UnixNano()
+}
+
+// Read the keyframe timestamps of the first video stream.
+// Only packets are read, so this does not decode the video.
+func (m *Manager) ffprobeKeyframes() (*KeyframeIndex, error) {
+	args := []string{
+		// Hide debug information
+		"-v", "error",
+
+		// Only the flags and timestamps of video packets
+		"-select_streams", "v:0",
+		"-show_entries", "packet=pts_time,flags",
+
+		"-of", "csv=print_section=0",
+		m.path,
+	}
+
+	ctx, cancel := context.WithDeadline(context.TODO(), time.Now().Add(60*time.Second))
+	defer cancel()
+	cmd := exec.CommandContext(ctx, m.c.FFprobe, args...)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	metrics.ffprobe["keyframes"].Observe(time.Since(start))
+	if err != nil {
+		m.logger().Error("ffprobe for keyframes failed", "err", err, "stderr", stderr.String())
+		return nil, err
+	}
+
+	// Each line is "pts_time,flags", e.g. "12.345000,K_"
+	keyframes := make([]float64, 0)
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ",")
+		if len(fields) < 2 || !strings.Contains(fields[1], "K") {
+			continue
+		}
+
+		pts, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue // N/A
+		}
+
+		// Seeking counts from the start time of the source
+		keyframes = append(keyframes, pts-m.probe.StartTime)
+	}
+
+	if len(keyframes) == 0 {
+		return nil, errors.New("no keyframes found")
+	}
+
+	// Packets are in decoding order
+	sort.Float64s(keyframes)
+
+	return &KeyframeIndex{
+		Keyframes: keyframes,
+		Duration:  m.probe.Duration.Seconds(),
+	}, nil
+}
+
+// Largest distance between two keyframes, including the end of the video
+func (k *KeyframeIndex) MaxInterval() float64 {
+	max := 0.0
+	for i := range k.Keyframes {
+		if d := k.end(i) - k.Keyframes[i]; d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+// Smallest distance between two keyframes
+func (k *KeyframeIndex) MinInterval() float64 {
+	min := k.Duration
+	for i := range k.Keyframes {
+		if d := k.end(i) - k.Keyframes[i]; d > 0 && d < min {
+			min = d
+		}
+	}
+	return min
+}
+
+// Average distance between two keyframes
+func (k *KeyframeIndex) AvgInterval() float64 {
+	return (k.Duration - k.Keyframes[0]) / float64(len(k.Keyframes))
+}
+
+// Group keyframes into segments of at least the given duration, or
+// one segment per keyframe for zero. Returns the start time of each
+// segment; every segment starts on a keyframe, except the first one
+// which starts with the video.
+func (k *KeyframeIndex) Segments(size float64) []float64 {
+	segments := []float64{0}
+	for _, kf := range k.Keyframes {
+		last := segments[len(segments)-1]
+		if kf > last && kf-last >= size && kf < k.Duration {
+			segments = append(segments, kf)
+		}
+	}
+	return segments
+}
+
+// Get segment start times of the given size, ignoring keyframes
+func fixedSegments(duration float64, size float64) []float64 {
+	segments := make([]float64, 0)
+	for t := 0.0; t < duration; t += size {
+		segments = append(segments, t)
+	}
+	if len(segments) == 0 {
+		segments = append(segments, 0)
+	}
+	return segments
+}
+
+// End of the keyframe interval starting at index i
+func (k *KeyframeIndex) end(i int) float64 {
+	if i+1 < len(k.Keyframes) {
+		return k.Keyframes[i+1]
+	}
+	return k.Duration
+}
+
+// Pixel formats that players decode, by codec. Only 8-bit 4:2:0 for
+// H.264; HEVC players also take 10-bit (Main 10).
+var copyPixFmts = map[string][]string{
+	CODEC_H264: {"yuv420p", "yuvj420p"},
+	CODEC_HEVC: {"yuv420p", "yuvj420p", "yuv420p10le"},
+}
+
+// Check if the original stream can be remuxed without re-encoding
+// into a stream of the given codec. Returns false if the source is
+// not suitable, i.e. it is another codec, has a pixel format players
+// cannot decode or the keyframes are too far apart for the chunk size.
+func (m *Manager) canCopy(codec string) bool {
+	k := m.keyframes
+	if k == nil || m.probe.CodecName != codec {
+		return false
+	}
+
+	supported := false
+	for _, pixFmt := range copyPixFmts[codec] {
+		supported = supported || m.probe.PixFmt == pixFmt
+	}
+	if !supported {
+		return false
+	}
+
+	// Cannot apply the transpose workaround without filters
+	if m.c.UseTranspose && m.probe.Rotation != 0 {
+		return false
+	}
+
+	// Every keyframe starts a segment, so they must fit into a
+	// chunk but should not be so close that segments become tiny
+	if k.MaxInterval() > float64(m.c.ChunkSize) || k.AvgInterval() < 1.0 {
+		m.logger().Info("keyframe spacing not suitable for remuxing", "min", k.MinInterval(), "max", k.MaxInterval())
+		return false
+	}
+
+	return true
+}
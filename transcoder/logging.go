@@ -0,0 +1,72 @@
+package transcoder
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Lines of ffmpeg stderr kept for failure reports
+const STDERR_TAIL = 50
+
+// At most STDERR_BURST lines of ffmpeg stderr are logged
+// per STDERR_INTERVAL; the rest are only counted
+const (
+	STDERR_BURST    = 10
+	STDERR_INTERVAL = 10 * time.Second
+)
+
+// Level of the default logger. Kept separately so that
+// replacing the configuration can change it.
+var logLevel = new(slog.LevelVar)
+
+// Set up the default logger from the configuration (level and
+// text or JSON output). Messages of the log package go to the
+// same logger at the info level.
+func SetupLogging(c *Config) {
+	logLevel.Set(parseLogLevel(c.LogLevel))
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+
+	var handler slog.Handler
+	if strings.EqualFold(c.LogFormat, "json") {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// Parse debug, info, warn or error (default info)
+func parseLogLevel(level string) slog.Level {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return slog.LevelInfo
+	}
+	return l
+}
+
+// Logger with the fields of the manager
+func (m *Manager) logger() *slog.Logger {
+	return slog.With("manager", m.id)
+}
+
+// Logger with the fields of the stream
+func (s *Stream) logger() *slog.Logger {
+	return slog.With("manager", s.m.id, "quality", s.quality)
+}
+
+// Remember a line of ffmpeg stderr for failure reports,
+// if it is from the current coder. Must be called with lock held.
+func (s *Stream) addStderr(coder *exec.Cmd, line string) {
+	if coder != s.coder {
+		return
+	}
+
+	s.stderrTail = append(s.stderrTail, line)
+	if len(s.stderrTail) > STDERR_TAIL {
+		s.stderrTail = s.stderrTail[len(s.stderrTail)-STDERR_TAIL:]
+	}
+}
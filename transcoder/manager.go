@@ -7,7 +7,6 @@ import (
 	"errors"
 	"fmt"
 	"hash/fnv"
-	"log"
 	"math"
 	"net/http"
 	"os"
@@ -15,6 +14,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,12 +25,20 @@ type Manager struct {
 	tempDir  string
 	id       string
 	close    chan string
-	inactive int
+	inactive int // guarded by mutex, -1 once destroyed
+	sched    *Scheduler
+	cache    *SegmentCache
 
 	probe     *ProbeVideoData
 	numChunks int
+	keyframes *KeyframeIndex
 
-	streams map[string]*Stream
+	streams   map[string]*Stream
+	subtitles map[string]*Subtitle
+
+	// Capabilities of the client of this session
+	mutex  sync.Mutex
+	client *ClientProfile
 }
 
 type ProbeVideoData struct {
@@ -41,10 +49,26 @@ type ProbeVideoData struct {
 	CodecName string
 	BitRate   int
 	Rotation  int
+	StartTime float64 // seconds of the first frame, kept with -copyts
+	PixFmt    string
+	Profile   string
+	Level     int
+	Audio     []*ProbeAudioData
+	Subtitles []*ProbeSubtitleData
+}
+
+type ProbeAudioData struct {
+	Index     int // among audio streams (0:a:N)
+	CodecName string
+	Channels  int
+	BitRate   int
+	Language  string
+	Title     string
+	Default   bool
 }
 
-func NewManager(c *Config, path string, id string, close chan string) (*Manager, error) {
-	m := &Manager{c: c, path: path, id: id, close: close}
+func NewManager(c *Config, path string, id string, close chan string, sched *Scheduler, cache *SegmentCache, client *ClientProfile) (*Manager, error) {
+	m := &Manager{c: c, path: path, id: id, close: close, sched: sched, cache: cache, client: client}
 	m.streams = make(map[string]*Stream)
 
 	h := fnv.New32a()
@@ -62,18 +86,25 @@ func NewManager(c *Config, path string, id string, close chan string) (*Manager,
 
 	m.numChunks = int(math.Ceil(m.probe.Duration.Seconds() / float64(c.ChunkSize)))
 
+	// Keyframe index for accurate segment boundaries. Until it
+	// is built in the background, chunks have a fixed duration.
+	m.keyframes = m.loadKeyframes()
+	if m.keyframes == nil {
+		m.logger().Info("no keyframe index yet, using fixed chunks")
+	}
+
 	// Possible streams (bitrates in bps for proper HLS BANDWIDTH reporting)
 	// Add extra low-bandwidth options for TV browsers and limited devices
-	if m.c.LowBandwidthMode {
-		m.streams["360p"] = &Stream{c: c, m: m, quality: "360p", height: 360, width: 640, bitrate: 500000}  // Ultra-low for TV
+	if m.client.LowBandwidth {
+		m.streams["360p"] = &Stream{c: c, m: m, quality: "360p", height: 360, width: 640, bitrate: 500000, pending: -1}  // Ultra-low for TV
 	}
-	m.streams["480p"] = &Stream{c: c, m: m, quality: "480p", height: 480, width: 854, bitrate: 800000}
-	m.streams["720p"] = &Stream{c: c, m: m, quality: "720p", height: 720, width: 1280, bitrate: 1500000}
-	m.streams["1080p"] = &Stream{c: c, m: m, quality: "1080p", height: 1080, width: 1920, bitrate: 3000000}
+	m.streams["480p"] = &Stream{c: c, m: m, quality: "480p", height: 480, width: 854, bitrate: 800000, pending: -1}
+	m.streams["720p"] = &Stream{c: c, m: m, quality: "720p", height: 720, width: 1280, bitrate: 1500000, pending: -1}
+	m.streams["1080p"] = &Stream{c: c, m: m, quality: "1080p", height: 1080, width: 1920, bitrate: 3000000, pending: -1}
 	
 	// Skip high res for low bandwidth mode
-	if !m.c.LowBandwidthMode {
-		m.streams["1440p"] = &Stream{c: c, m: m, quality: "1440p", height: 1440, width: 2560, bitrate: 6000000}
+	if !m.client.LowBandwidth {
+		m.streams["1440p"] = &Stream{c: c, m: m, quality: "1440p", height: 1440, width: 2560, bitrate: 6000000, pending: -1}
 	}
 
 	// height is our primary dimension for scaling
@@ -99,7 +130,7 @@ func NewManager(c *Config, path string, id string, close chan string) (*Manager,
 	// For very high bitrate content (>50Mbps), adjust quality targets
 	isHighBitrate := m.probe.BitRate > 50000000
 	if isHighBitrate {
-		log.Printf("%s: detected high bitrate content (%d bps), optimizing settings", m.id, m.probe.BitRate)
+		m.logger().Info("detected high bitrate content, optimizing settings", "bitrate", m.probe.BitRate)
 		// Increase reference bitrate for high bitrate sources to maintain quality
 		refBitrate = int(float64(refBitrate) * 1.2)
 	}
@@ -144,8 +175,8 @@ func NewManager(c *Config, path string, id string, close chan string) (*Manager,
 		aspectRatio := float64(sourceWidth) / float64(sourceHeight)
 		stream.width = int(math.Ceil(float64(stream.height) * aspectRatio))
 		
-		log.Printf("%s: stream %s - source: %dx%d (rotation: %d), target: %dx%d, aspect: %.2f", 
-			m.id, k, m.probe.Width, m.probe.Height, m.probe.Rotation, stream.width, stream.height, aspectRatio)
+		m.logger().Debug("stream size", "quality", k, "sourceWidth", m.probe.Width, "sourceHeight", m.probe.Height,
+			"rotation", m.probe.Rotation, "width", stream.width, "height", stream.height, "aspect", aspectRatio)
 		
 		// Ensure even dimensions for encoder compatibility
 		if stream.width%2 != 0 {
@@ -158,7 +189,7 @@ func NewManager(c *Config, path string, id string, close chan string) (*Manager,
 		// Special handling for square or unusual aspect ratios
 		isSquareish := math.Abs(aspectRatio-1.0) < 0.1 // within 10% of square
 		if isSquareish {
-			log.Printf("%s: detected square/unusual aspect ratio %.2f for %s", m.id, aspectRatio, k)
+			m.logger().Info("detected square or unusual aspect ratio", "quality", k, "aspect", aspectRatio)
 		}
 
 		// remove invalid streams
@@ -180,17 +211,65 @@ func NewManager(c *Config, path string, id string, close chan string) (*Manager,
 		width:   m.probe.Width,
 		bitrate: refBitrate,
 		order:   1,
+		pending: -1,
+	}
+
+	// Remux the original stream if it is already compatible
+	if m.canCopy(CODEC_H264) {
+		m.logger().Info("remuxing original stream", "keyframes", len(m.keyframes.Keyframes))
+		max := m.streams[QUALITY_MAX]
+		max.encoder = GetEncoder(ENCODER_COPY)
+		max.bitrate = m.probe.BitRate
+		max.segments = m.keyframes.Segments(0) // one chunk per keyframe
+		max.aligned = true
+	}
+
+	// Segment boundaries of re-encoded streams. With a fixed GOP size
+	// the keyframes of the output cannot follow those of the source.
+	segments := fixedSegments(m.probe.Duration.Seconds(), float64(c.ChunkSize))
+	aligned := false
+	if m.keyframes != nil && !c.UseGopSize {
+		segments = m.keyframes.Segments(float64(c.ChunkSize))
+		aligned = true
 	}
 
 	// Start all streams with concurrent management
 	streamCount := len(m.streams)
-	log.Printf("%s: starting %d streams with max %d concurrent transcodes", m.id, streamCount, m.c.MaxConcurrentTranscodes)
+	m.logger().Info("starting streams", "streams", streamCount, "maxConcurrent", m.c.MaxConcurrentTranscodes)
 	
+	// Audio tracks
+	m.addAudioStreams()
+
+	// Subtitle tracks
+	m.addSubtitles()
+
+	// HEVC and AV1 variants sharing the audio renditions
+	m.addVideoVariants()
+
+	encoder := c.DefaultEncoder()
+	for _, stream := range m.streams {
+		if stream.audio != nil {
+			// Audio has no keyframes to align to
+			stream.segments = fixedSegments(m.probe.Duration.Seconds(), float64(c.ChunkSize))
+		} else {
+			if stream.encoder == nil {
+				stream.encoder = encoder
+			}
+			if stream.segments == nil {
+				stream.segments = segments
+				stream.aligned = aligned
+			}
+		}
+	}
+
+	// Both containers of every stream
+	m.addContainerTwins()
+
 	for _, stream := range m.streams {
 		go stream.Run()
 	}
 
-	log.Printf("%s: new manager for %s", m.id, m.path)
+	m.logger().Info("new manager", "path", m.path)
 
 	// Check for inactivity
 	go func() {
@@ -199,7 +278,9 @@ func NewManager(c *Config, path string, id string, close chan string) (*Manager,
 		for {
 			<-t.C
 
+			m.mutex.Lock()
 			if m.inactive == -1 {
+				m.mutex.Unlock()
 				t.Stop()
 				return
 			}
@@ -208,14 +289,16 @@ func NewManager(c *Config, path string, id string, close chan string) (*Manager,
 
 			// Check if any stream is active
 			for _, stream := range m.streams {
-				if stream.coder != nil {
+				if stream.coder != nil || stream.pending >= 0 {
 					m.inactive = 0
 					break
 				}
 			}
+			idle := m.inactive >= m.c.ManagerIdleTime/5
+			m.mutex.Unlock()
 
 			// Nothing done for 5 minutes
-			if m.inactive >= m.c.ManagerIdleTime/5 {
+			if idle {
 				t.Stop()
 				m.Destroy()
 				m.close <- m.id
@@ -229,8 +312,10 @@ func NewManager(c *Config, path string, id string, close chan string) (*Manager,
 
 // Destroys streams. DOES NOT emit on the close channel.
 func (m *Manager) Destroy() {
-	log.Printf("%s: destroying manager", m.id)
+	m.logger().Info("destroying manager")
+	m.mutex.Lock()
 	m.inactive = -1
+	m.mutex.Unlock()
 
 	for _, stream := range m.streams {
 		stream.Stop()
@@ -246,9 +331,18 @@ func (m *Manager) Destroy() {
 func (m *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request, chunk string) error {
 	// Master list
 	if chunk == "index.m3u8" {
+		m.setClient(NewClientProfile(m.c, r))
 		return m.ServeIndex(w, r)
 	}
 
+	// DASH manifest; the segments are always fMP4
+	if chunk == "manifest.mpd" {
+		client := NewClientProfile(m.c, r)
+		client.FMP4 = true
+		m.setClient(client)
+		return m.ServeManifest(w, r)
+	}
+
 	// Stream list
 	m3u8Sfx := ".m3u8"
 	if strings.HasSuffix(chunk, m3u8Sfx) {
@@ -256,6 +350,54 @@ func (m *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request, chunk string
 		if stream, ok := m.streams[quality]; ok {
 			return stream.ServeList(w, r)
 		}
+		if sub, ok := m.subtitles[quality]; ok {
+			return sub.ServeList(w, r)
+		}
+	}
+
+	// Subtitle segment
+	vttSfx := ".vtt"
+	if strings.HasSuffix(chunk, vttSfx) {
+		parts := strings.Split(strings.TrimSuffix(chunk, vttSfx), "-")
+		if len(parts) != 2 {
+			w.WriteHeader(http.StatusBadRequest)
+			return nil
+		}
+
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return nil
+		}
+
+		if sub, ok := m.subtitles[parts[0]]; ok {
+			return sub.ServeChunk(w, id)
+		}
+	}
+
+	// Why transcoding failed
+	errorSfx := "-error.json"
+	if strings.HasSuffix(chunk, errorSfx) {
+		if stream, ok := m.streams[strings.TrimSuffix(chunk, errorSfx)]; ok {
+			return stream.ServeError(w)
+		}
+	}
+
+	// fMP4 initialization segment
+	initSfx := "-init.mp4"
+	if strings.HasSuffix(chunk, initSfx) {
+		if stream, ok := m.streams[strings.TrimSuffix(chunk, initSfx)]; ok {
+			return stream.ServeInit(w)
+		}
+	}
+
+	// Single fMP4 file of a coder, requested with byte ranges
+	fileSep := "-file-"
+	if strings.HasSuffix(chunk, ".mp4") && strings.Contains(chunk, fileSep) {
+		quality := chunk[:strings.Index(chunk, fileSep)]
+		if stream, ok := m.streams[quality]; ok {
+			return stream.ServeFile(w, r, chunk)
+		}
 	}
 
 	// Stream chunk (support both TS and MP4)
@@ -308,18 +450,19 @@ func (m *Manager) ServeIndex(w http.ResponseWriter, r *http.Request) error {
 	WriteM3U8ContentType(w)
 	w.Write([]byte("#EXTM3U\n"))
 
-	// get sorted streams by bitrate
-	streams := make([]*Stream, 0)
-	for _, stream := range m.streams {
-		streams = append(streams, stream)
-	}
-	sort.Slice(streams, func(i, j int) bool {
-		return streams[i].order < streams[j].order ||
-			(streams[i].order == streams[j].order && streams[i].bitrate < streams[j].bitrate)
-	})
+	// get sorted streams by bitrate, leaving out
+	// those the client cannot play
+	client := m.getClient()
+	streams := m.clientStreams(client)
 
 	// Write all streams with enhanced ABR information
 	query := GetQueryString(r)
+
+	// Audio renditions shared by the streams
+	audioGroups := m.writeAudioMedia(w, client, query)
+
+	// Subtitle renditions
+	m.writeSubtitleMedia(w, query)
 	
 	// Client capability detection
 	clientHints := ""
@@ -329,12 +472,29 @@ func (m *Manager) ServeIndex(w http.ResponseWriter, r *http.Request) error {
 	}
 	
 	for _, stream := range streams {
+		// Bandwidth and codecs include the audio renditions
+		codecs := []string{stream.encoder.Profile(stream).String()}
+		bandwidth := stream.bitrate
+		audio := audioGroups[stream.audioGroup]
+		if audio != nil && len(audio.streams) > 0 {
+			codecs = append(codecs, audio.codecs...)
+			bandwidth += audio.bitrate
+		}
+
 		// Calculate average bandwidth (slightly lower than peak for better ABR decisions)
-		avgBandwidth := int(float64(stream.bitrate) * 0.85)
+		avgBandwidth := int(float64(bandwidth) * 0.85)
 		
 		// Enhanced HLS stream info for better client decision making
-		streamInfo := fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,RESOLUTION=%dx%d,FRAME-RATE=%d,CODECS=\"avc1.42E01E,mp4a.40.2\"", 
-			stream.bitrate, avgBandwidth, stream.width, stream.height, m.probe.FrameRate)
+		streamInfo := fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,RESOLUTION=%dx%d,FRAME-RATE=%d,CODECS=\"%s\"", 
+			bandwidth, avgBandwidth, stream.width, stream.height, m.probe.FrameRate, strings.Join(codecs, ","))
+
+		if audio != nil && len(audio.streams) > 0 {
+			streamInfo += fmt.Sprintf(",AUDIO=\"%s\"", stream.audioGroup)
+		}
+
+		if len(m.subtitles) > 0 {
+			streamInfo += fmt.Sprintf(",SUBTITLES=\"%s\"", SUBTITLE_GROUP)
+		}
 		
 		// Add client-specific hints if available
 		if clientHints != "" {
@@ -347,6 +507,14 @@ func (m *Manager) ServeIndex(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// Sort streams by order and bitrate
+func sortStreams(streams []*Stream) {
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].order < streams[j].order ||
+			(streams[i].order == streams[j].order && streams[i].bitrate < streams[j].bitrate)
+	})
+}
+
 // Analyze client capabilities based on User-Agent and other headers
 func (m *Manager) analyzeClientCapabilities(userAgent string) string {
 	hints := make([]string, 0)
@@ -359,7 +527,6 @@ func (m *Manager) analyzeClientCapabilities(userAgent string) string {
 	if strings.Contains(ua, "tv") || strings.Contains(ua, "smarttv") || strings.Contains(ua, "roku") || strings.Contains(ua, "chromecast") {
 		hints = append(hints, "DEVICE-TYPE=\"tv\"")
 		hints = append(hints, "PREFERRED-MAX-BANDWIDTH=4000000") // Conservative for TV browsers
-		m.setLowBandwidthMode(true) // Enable low bandwidth mode for TV
 	} else if strings.Contains(ua, "mobile") || strings.Contains(ua, "android") || strings.Contains(ua, "iphone") {
 		hints = append(hints, "DEVICE-TYPE=\"mobile\"")
 		hints = append(hints, "PREFERRED-MAX-BANDWIDTH=2000000")
@@ -424,7 +591,6 @@ func (m *Manager) detectBrowserCapabilities(ua string) []string {
 		caps = append(caps, "BROWSER=\"unknown\"")
 		caps = append(caps, "SUPPORTS-FMP4=false")
 		caps = append(caps, "HLS-VERSION=3")
-		m.setForceCompatibility(true)
 	}
 	
 	// Android WebView detection (often problematic)
@@ -437,21 +603,6 @@ func (m *Manager) detectBrowserCapabilities(ua string) []string {
 	return caps
 }
 
-// Helper functions for dynamic configuration
-func (m *Manager) setLowBandwidthMode(enabled bool) {
-	if m.c.LowBandwidthMode != enabled {
-		log.Printf("%s: setting low bandwidth mode: %v", m.id, enabled)
-		m.c.LowBandwidthMode = enabled
-	}
-}
-
-func (m *Manager) setForceCompatibility(enabled bool) {
-	if m.c.ForceCompatibility != enabled {
-		log.Printf("%s: setting force compatibility mode: %v", m.id, enabled)
-		m.c.ForceCompatibility = enabled
-	}
-}
-
 func (m *Manager) ffprobe() error {
 	args := []string{
 		// Hide debug information
@@ -459,7 +610,6 @@ func (m *Manager) ffprobe() error {
 
 		// Show everything
 		"-show_entries", "format:stream",
-		"-select_streams", "v", // Video stream only, we're not interested in audio
 
 		"-of", "json",
 		m.path,
@@ -473,27 +623,45 @@ func (m *Manager) ffprobe() error {
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
+	start := time.Now()
 	err := cmd.Run()
+	metrics.ffprobe["probe"].Observe(time.Since(start))
 	if err != nil {
-		log.Println(stderr.String())
+		m.logger().Error("ffprobe failed", "err", err, "stderr", stderr.String())
 		return err
 	}
 
 	out := struct {
 		Streams []struct {
+			CodecType    string `json:"codec_type"`
 			Width        int    `json:"width"`
 			Height       int    `json:"height"`
 			Duration     string `json:"duration"`
+			StartTime    string `json:"start_time"`
 			FrameRate    string `json:"avg_frame_rate"`
 			CodecName    string `json:"codec_name"`
+			PixFmt       string `json:"pix_fmt"`
+			Profile      string `json:"profile"`
+			Level        int    `json:"level"`
 			BitRate      string `json:"bit_rate"`
+			Channels     int    `json:"channels"`
+			Tags         struct {
+				Language string `json:"language"`
+				Title    string `json:"title"`
+			} `json:"tags"`
+			Disposition struct {
+				Default     int `json:"default"`
+				Forced      int `json:"forced"`
+				AttachedPic int `json:"attached_pic"`
+			} `json:"disposition"`
 			SideDataList []struct {
 				SideDataType string `json:"side_data_type"`
 				Rotation     int    `json:"rotation"`
 			} `json:"side_data_list"`
 		} `json:"streams"`
 		Format struct {
-			Duration string `json:"duration"`
+			Duration  string `json:"duration"`
+			StartTime string `json:"start_time"`
 		} `json:"format"`
 	}{}
 
@@ -501,19 +669,56 @@ func (m *Manager) ffprobe() error {
 		return err
 	}
 
-	if len(out.Streams) == 0 {
+	// Get the first video stream and all audio and subtitle streams.
+	// Cover art shows up as a video stream too.
+	video := -1
+	audio := make([]*ProbeAudioData, 0)
+	subtitles := make([]*ProbeSubtitleData, 0)
+	for i, stream := range out.Streams {
+		if stream.CodecType == "video" && stream.Disposition.AttachedPic == 0 && video == -1 {
+			video = i
+		} else if stream.CodecType == "audio" {
+			audio = append(audio, &ProbeAudioData{
+				Index:     len(audio),
+				CodecName: stream.CodecName,
+				Channels:  stream.Channels,
+				BitRate:   atoiOrZero(stream.BitRate),
+				Language:  stream.Tags.Language,
+				Title:     stream.Tags.Title,
+				Default:   stream.Disposition.Default == 1,
+			})
+		} else if stream.CodecType == "subtitle" {
+			subtitles = append(subtitles, &ProbeSubtitleData{
+				Index:     len(subtitles),
+				CodecName: stream.CodecName,
+				Language:  stream.Tags.Language,
+				Title:     stream.Tags.Title,
+				Default:   stream.Disposition.Default == 1,
+				Forced:    stream.Disposition.Forced == 1,
+			})
+		}
+	}
+
+	if video == -1 {
 		return errors.New("no video streams found")
 	}
+	vs := out.Streams[video]
 
 	var duration time.Duration
-	if out.Streams[0].Duration != "" {
-		duration, _ = time.ParseDuration(out.Streams[0].Duration + "s")
+	if vs.Duration != "" {
+		duration, _ = time.ParseDuration(vs.Duration + "s")
 	} else if out.Format.Duration != "" {
 		duration, _ = time.ParseDuration(out.Format.Duration + "s")
 	}
 
+	// Start of the video stream, else of the file
+	startTime, err := strconv.ParseFloat(vs.StartTime, 64)
+	if err != nil {
+		startTime, _ = strconv.ParseFloat(out.Format.StartTime, 64)
+	}
+
 	// FrameRate is a fraction string
-	frac := strings.Split(out.Streams[0].FrameRate, "/")
+	frac := strings.Split(vs.FrameRate, "/")
 	if len(frac) != 2 {
 		frac = []string{"30", "1"}
 	}
@@ -526,27 +731,33 @@ func (m *Manager) ffprobe() error {
 	frameRate := float64(num) / float64(den)
 
 	// BitRate is a string
-	bitRate, err := strconv.Atoi(out.Streams[0].BitRate)
+	bitRate, err := strconv.Atoi(vs.BitRate)
 	if err != nil {
 		bitRate = 5000000
 	}
 
 	// Get rotation from side data
 	rotation := 0
-	for _, sideData := range out.Streams[0].SideDataList {
+	for _, sideData := range vs.SideDataList {
 		if sideData.SideDataType == "Display Matrix" {
 			rotation = sideData.Rotation
 		}
 	}
 
 	m.probe = &ProbeVideoData{
-		Width:     out.Streams[0].Width,
-		Height:    out.Streams[0].Height,
+		Width:     vs.Width,
+		Height:    vs.Height,
 		Duration:  duration,
 		FrameRate: int(frameRate),
-		CodecName: out.Streams[0].CodecName,
+		CodecName: vs.CodecName,
 		BitRate:   bitRate,
 		Rotation:  rotation,
+		StartTime: startTime,
+		PixFmt:    vs.PixFmt,
+		Profile:   vs.Profile,
+		Level:     vs.Level,
+		Audio:     audio,
+		Subtitles: subtitles,
 	}
 
 	return nil
@@ -0,0 +1,151 @@
+package transcoder
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counters of the transcoding activity of the process, exported
+// in the Prometheus text format on /metrics. Gauges such as the
+// number of managers are read from the Handler when scraped.
+type Metrics struct {
+	chunkWait *histogram
+	ffprobe   map[string]*histogram // by kind (probe, keyframes)
+
+	timeouts  int64 // 408 while waiting for a chunk
+	conflicts int64 // 409 since the coder was changed
+	restarts  int64
+	bytes     int64 // bytes of chunks served
+}
+
+var metrics = &Metrics{
+	chunkWait: newHistogram([]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}),
+	ffprobe: map[string]*histogram{
+		"probe":     newHistogram([]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}),
+		"keyframes": newHistogram([]float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60}),
+	},
+}
+
+type histogram struct {
+	mutex   sync.Mutex
+	buckets []float64 // upper bounds
+	counts  []int64
+	count   int64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]int64, len(buckets)),
+	}
+}
+
+func (h *histogram) Observe(d time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	v := d.Seconds()
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Write the series of the histogram. Labels are
+// given without braces, e.g. `kind="probe"`.
+func (h *histogram) write(w io.Writer, name string, labels string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+
+	for i, le := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", name, labels, sep, le, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+// Serve the metrics in the Prometheus text format
+func (h *Handler) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	h.mutex.RLock()
+	managers := make([]*Manager, 0, len(h.managers))
+	for _, m := range h.managers {
+		managers = append(managers, m)
+	}
+	h.mutex.RUnlock()
+
+	// Streams with a coder, and live coders holding a slot or
+	// stopped (SIGSTOP) without one, either preempted or with
+	// their goal satisfied
+	active, running, stopped := 0, 0, 0
+	for _, m := range managers {
+		for _, s := range m.streams {
+			s.mutex.Lock()
+			if s.coder != nil || s.pending >= 0 {
+				active++
+			}
+			if s.coder != nil && !s.coderFailed() {
+				if h.sched.Running(s) {
+					running++
+				} else {
+					stopped++
+				}
+			}
+			s.mutex.Unlock()
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	gauge := func(name string, help string, value interface{}) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", name, help, name, name, value)
+	}
+	counter := func(name string, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+
+	gauge("go_vod_managers", "Number of active managers.", len(managers))
+	gauge("go_vod_streams_active", "Number of streams transcoding or queued.", active)
+
+	fmt.Fprintf(w, "# HELP go_vod_ffmpeg_processes Number of ffmpeg processes by state.\n")
+	fmt.Fprintf(w, "# TYPE go_vod_ffmpeg_processes gauge\n")
+	fmt.Fprintf(w, "go_vod_ffmpeg_processes{state=\"running\"} %d\n", running)
+	fmt.Fprintf(w, "go_vod_ffmpeg_processes{state=\"stopped\"} %d\n", stopped)
+
+	gauge("go_vod_tempdir_bytes", "Bytes used in the temp directory.", dirSize(h.c.TempDir))
+
+	fmt.Fprintf(w, "# HELP go_vod_chunk_errors_total Chunk requests that failed while waiting, by status code.\n")
+	fmt.Fprintf(w, "# TYPE go_vod_chunk_errors_total counter\n")
+	fmt.Fprintf(w, "go_vod_chunk_errors_total{code=\"408\"} %d\n", atomic.LoadInt64(&metrics.timeouts))
+	fmt.Fprintf(w, "go_vod_chunk_errors_total{code=\"409\"} %d\n", atomic.LoadInt64(&metrics.conflicts))
+
+	counter("go_vod_restarts_total", "Number of times transcoding was restarted at a chunk.", atomic.LoadInt64(&metrics.restarts))
+	counter("go_vod_served_bytes_total", "Bytes of chunks served.", atomic.LoadInt64(&metrics.bytes))
+
+	fmt.Fprintf(w, "# HELP go_vod_chunk_wait_seconds Time players waited for a chunk to be transcoded.\n")
+	fmt.Fprintf(w, "# TYPE go_vod_chunk_wait_seconds histogram\n")
+	metrics.chunkWait.write(w, "go_vod_chunk_wait_seconds", "")
+
+	fmt.Fprintf(w, "# HELP go_vod_ffprobe_duration_seconds Duration of ffprobe runs by kind.\n")
+	fmt.Fprintf(w, "# TYPE go_vod_ffprobe_duration_seconds histogram\n")
+	for _, kind := range []string{"probe", "keyframes"} {
+		metrics.ffprobe[kind].write(w, "go_vod_ffprobe_duration_seconds", fmt.Sprintf("kind=%q", kind))
+	}
+}
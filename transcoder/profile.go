@@ -0,0 +1,228 @@
+package transcoder
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Codec profile and level of an encoded video stream
+type CodecProfile struct {
+	Codec   string // e.g. h264
+	Profile string // ffmpeg profile name, e.g. high
+	Level   int    // level as major*10+minor, e.g. 41 for 4.1
+}
+
+// Limits of H.264 levels (Table A-1), in increasing order
+var h264Levels = []struct {
+	level int
+	mbps  int // max macroblocks per second
+	fs    int // max frame size in macroblocks
+	br    int // max bitrate for High profile in kbps
+}{
+	{30, 40500, 1620, 12500},
+	{31, 108000, 3600, 17500},
+	{32, 216000, 5120, 25000},
+	{40, 245760, 8192, 25000},
+	{41, 245760, 8192, 62500},
+	{42, 522240, 8704, 62500},
+	{50, 589824, 22080, 168750},
+	{51, 983040, 36864, 300000},
+	{52, 2073600, 36864, 300000},
+	{60, 4177920, 139264, 300000},
+	{61, 8355840, 139264, 600000},
+	{62, 16711680, 139264, 1000000},
+}
+
+// Get the lowest H.264 level that fits the stream
+func h264Level(width int, height int, fps int, bitrate int) int {
+	if fps <= 0 {
+		fps = 30
+	}
+
+	fs := ((width + 15) / 16) * ((height + 15) / 16)
+	mbps := fs * fps
+	br := bitrate / 1000
+
+	for _, l := range h264Levels {
+		if fs <= l.fs && mbps <= l.mbps && br <= l.br {
+			return l.level
+		}
+	}
+	return h264Levels[len(h264Levels)-1].level
+}
+
+// Limits of HEVC (Main tier, Table A.8) and AV1 (Annex A.3) levels
+// by luma samples, in increasing order
+type lumaLevel struct {
+	level int
+	ps    int // max luma picture size
+	sr    int // max luma sample rate
+	br    int // max bitrate for Main tier in kbps
+}
+
+var hevcLevels = []lumaLevel{
+	{30, 552960, 16588800, 6000},
+	{31, 983040, 33177600, 10000},
+	{40, 2228224, 66846720, 12000},
+	{41, 2228224, 133693440, 20000},
+	{50, 8912896, 267386880, 25000},
+	{51, 8912896, 534773760, 40000},
+	{52, 8912896, 1069547520, 60000},
+	{60, 35651584, 1069547520, 60000},
+	{61, 35651584, 2139095040, 120000},
+	{62, 35651584, 4278190080, 240000},
+}
+
+var av1Levels = []lumaLevel{
+	{20, 147456, 4423680, 1500},
+	{21, 278784, 8363520, 3000},
+	{30, 665856, 19975680, 6000},
+	{31, 1065024, 31950720, 10000},
+	{40, 2359296, 70778880, 12000},
+	{41, 2359296, 141557760, 20000},
+	{50, 8912896, 267386880, 30000},
+	{51, 8912896, 534773760, 40000},
+	{52, 8912896, 1069547520, 60000},
+	{53, 8912896, 1069547520, 60000},
+	{60, 35651584, 1069547520, 60000},
+	{61, 35651584, 2139095040, 100000},
+	{62, 35651584, 4278190080, 160000},
+}
+
+// Get the lowest level in the table that fits the stream
+func findLumaLevel(levels []lumaLevel, width int, height int, fps int, bitrate int) int {
+	if fps <= 0 {
+		fps = 30
+	}
+
+	ps := width * height
+	sr := ps * fps
+	br := bitrate / 1000
+
+	for _, l := range levels {
+		if ps <= l.ps && sr <= l.sr && br <= l.br {
+			return l.level
+		}
+	}
+	return levels[len(levels)-1].level
+}
+
+// Profile used by all H.264 encoders for the stream
+func h264Profile(s *Stream) *CodecProfile {
+	return &CodecProfile{
+		Codec:   CODEC_H264,
+		Profile: "high",
+		Level:   h264Level(s.width, s.height, s.m.probe.FrameRate, s.bitrate),
+	}
+}
+
+// Profile used by all HEVC encoders for the stream
+func hevcProfile(s *Stream) *CodecProfile {
+	return &CodecProfile{
+		Codec:   CODEC_HEVC,
+		Profile: "main",
+		Level:   findLumaLevel(hevcLevels, s.width, s.height, s.m.probe.FrameRate, s.bitrate),
+	}
+}
+
+// Profile used by all AV1 encoders for the stream
+func av1Profile(s *Stream) *CodecProfile {
+	return &CodecProfile{
+		Codec:   CODEC_AV1,
+		Profile: "main",
+		Level:   findLumaLevel(av1Levels, s.width, s.height, s.m.probe.FrameRate, s.bitrate),
+	}
+}
+
+// Profile of the source video from ffprobe
+func sourceProfile(s *Stream) *CodecProfile {
+	p := &CodecProfile{
+		Codec:   s.m.probe.CodecName,
+		Profile: strings.ToLower(s.m.probe.Profile),
+		Level:   s.m.probe.Level,
+	}
+
+	// ffprobe gives general_level_idc for HEVC, 30 times the level
+	if p.Codec == CODEC_HEVC {
+		p.Level /= 3
+	}
+	return p
+}
+
+// Arguments to request the profile from the encoder
+func profileArgs(p *CodecProfile) []string {
+	return []string{
+		"-profile:v", p.Profile,
+		"-level:v", fmt.Sprintf("%d.%d", p.Level/10, p.Level%10),
+	}
+}
+
+// Value for the CODECS attribute (RFC 6381)
+func (p *CodecProfile) String() string {
+	if p.Codec == CODEC_H264 {
+		// profile_idc and constraint flags
+		idc := "6400"
+		switch p.Profile {
+		case "constrained baseline":
+			idc = "42E0"
+		case "baseline":
+			idc = "4200"
+		case "main":
+			idc = "4D40"
+		case "extended":
+			idc = "58A0"
+		case "high":
+			idc = "6400"
+		case "high 10":
+			idc = "6E00"
+		case "high 4:2:2":
+			idc = "7A00"
+		case "high 4:4:4 predictive":
+			idc = "F400"
+		}
+
+		level := p.Level
+		if level <= 0 {
+			level = 40
+		}
+
+		return fmt.Sprintf("avc1.%s%02X", idc, level)
+	}
+
+	if p.Codec == CODEC_HEVC {
+		// general_profile_idc and compatibility flags
+		profile := "1.6"
+		if p.Profile == "main10" || p.Profile == "main 10" { // as probed
+			profile = "2.4"
+		}
+
+		// general_level_idc is 30 times the level
+		level := p.Level
+		if level <= 0 {
+			level = 41
+		}
+
+		return fmt.Sprintf("hvc1.%s.L%d.B0", profile, level*3)
+	}
+
+	if p.Codec == CODEC_AV1 {
+		profile := 0
+		switch p.Profile {
+		case "high":
+			profile = 1
+		case "professional":
+			profile = 2
+		}
+
+		// seq_level_idx counts four minor levels per major level from 2.0
+		level := p.Level
+		if level < 20 {
+			level = 41
+		}
+		idx := (level/10-2)*4 + level%10
+
+		return fmt.Sprintf("av01.%d.%02dM.08", profile, idx)
+	}
+
+	return p.Codec
+}
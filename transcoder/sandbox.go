@@ -0,0 +1,103 @@
+package transcoder
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Resolve the path of a source file and check that it may be read.
+// Only regular files are allowed, and if Config.AllowedRoots is set,
+// only below one of the roots or the temp directory after resolving
+// symlinks. Returns the resolved path, or an error that satisfies
+// os.IsNotExist if the file does not exist but would be allowed.
+func (c *Config) CheckPath(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", errors.New("path is not absolute")
+	}
+
+	real, err := filepath.EvalSymlinks(filepath.Clean(path))
+	if err != nil {
+		// Do not tell if files outside the roots exist
+		if os.IsNotExist(err) && !c.allowedPath(resolveMissing(path)) {
+			return "", errors.New("path is outside the allowed roots")
+		}
+		return "", err
+	}
+
+	// No devices, pipes or directories
+	info, err := os.Stat(real)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", errors.New("not a regular file")
+	}
+
+	if !c.allowedPath(real) {
+		return "", errors.New("path is outside the allowed roots")
+	}
+	return real, nil
+}
+
+// Check if a resolved path is below one of the allowed roots
+func (c *Config) allowedPath(real string) bool {
+	if len(c.AllowedRoots) == 0 {
+		return true
+	}
+
+	// Uploaded files are in the temp directory
+	for _, root := range append([]string{c.TempDir}, c.AllowedRoots...) {
+		root, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			continue
+		}
+
+		rel, err := filepath.Rel(root, real)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Resolve the symlinks of the deepest existing parent
+// of a missing path, keeping the rest as it is
+func resolveMissing(path string) string {
+	path = filepath.Clean(path)
+	dir, rest := path, ""
+	for {
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			return filepath.Join(real, rest)
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return path
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+		dir = parent
+	}
+}
+
+// Check the source path of a request, responding with 403 if it may
+// not be read. Missing files are allowed if allowMissing is set.
+// Returns the resolved path and whether the request can continue.
+func (h *Handler) checkPath(w http.ResponseWriter, path string, allowMissing bool) (string, bool) {
+	real, err := h.c.CheckPath(path)
+	if err == nil {
+		return real, true
+	}
+
+	if allowMissing && os.IsNotExist(err) {
+		return path, true
+	}
+
+	slog.Warn("forbidden path", "path", path, "err", err)
+	w.WriteHeader(http.StatusForbidden)
+	return "", false
+}
@@ -0,0 +1,292 @@
+package transcoder
+
+import (
+	"runtime"
+	"sync"
+	"syscall"
+)
+
+// Scheduler admits ffmpeg processes against Config.MaxConcurrentTranscodes.
+// It is shared by all managers of a Handler. A stream holds a slot while its
+// coder is running; stopping the coder (SIGSTOP or kill) releases the slot.
+//
+// Streams with a player blocked in waitForChunk are interactive and always
+// go first. If no slot is free for an interactive stream, a background
+// (pre-buffering) stream is suspended to make room for it.
+type Scheduler struct {
+	c *Config
+
+	mutex   sync.Mutex
+	tickets map[*Stream]*ticket
+	queue   []*ticket // waiting for a slot, in arrival order
+	running int
+}
+
+type ticket struct {
+	s       *Stream
+	waiters int // players blocked on this stream
+	running bool
+}
+
+func (t *ticket) interactive() bool {
+	return t.waiters > 0
+}
+
+func NewScheduler(c *Config) *Scheduler {
+	return &Scheduler{
+		c:       c,
+		tickets: make(map[*Stream]*ticket),
+		queue:   make([]*ticket, 0),
+	}
+}
+
+// Maximum number of running coders. Read every time since
+// the configuration may be replaced at runtime.
+func (q *Scheduler) limit() int {
+	if q.c.MaxConcurrentTranscodes > 0 {
+		return q.c.MaxConcurrentTranscodes
+	}
+
+	n := runtime.NumCPU() / 2
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// Request a slot for the stream. Returns true if the stream can run
+// right away; otherwise it is queued and Stream.admit is called
+// asynchronously once a slot is available.
+func (q *Scheduler) Request(s *Stream) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	t := q.tickets[s]
+	if t == nil {
+		t = &ticket{s: s}
+		q.tickets[s] = t
+	}
+
+	if t.running {
+		return true
+	}
+
+	// Fast path: nobody else is waiting
+	if len(q.queue) == 0 && q.running < q.limit() {
+		t.running = true
+		q.running++
+		return true
+	}
+
+	q.enqueue(t)
+	q.schedule()
+
+	// schedule() may have admitted us (e.g. by preemption), but
+	// the admission callback is already on its way in that case.
+	return false
+}
+
+// Release the slot (or queue position) held by the stream.
+func (q *Scheduler) Release(s *Stream) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	t := q.tickets[s]
+	if t == nil {
+		return
+	}
+
+	if t.running {
+		q.running--
+	} else {
+		q.dequeue(t)
+	}
+
+	// Keep the ticket around if there are players blocked on it
+	// so that a new request for the stream retains its priority
+	t.running = false
+	if t.waiters == 0 {
+		delete(q.tickets, s)
+	}
+
+	q.schedule()
+}
+
+// Block marks that a player is waiting for a chunk of this stream.
+func (q *Scheduler) Block(s *Stream) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	t := q.tickets[s]
+	if t == nil {
+		t = &ticket{s: s}
+		q.tickets[s] = t
+	}
+	t.waiters++
+
+	// Queued tickets may now go ahead of background work
+	if !t.running {
+		q.schedule()
+	}
+}
+
+// Unblock reverts a previous call to Block.
+func (q *Scheduler) Unblock(s *Stream) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	t := q.tickets[s]
+	if t == nil {
+		return
+	}
+
+	t.waiters--
+	if t.waiters <= 0 {
+		t.waiters = 0
+		if !t.running && !q.queued(t) {
+			delete(q.tickets, s)
+		}
+	}
+}
+
+// Running returns true if the stream currently holds a slot.
+func (q *Scheduler) Running(s *Stream) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	t := q.tickets[s]
+	return t != nil && t.running
+}
+
+// Must be called with lock held
+func (q *Scheduler) enqueue(t *ticket) {
+	if !q.queued(t) {
+		q.queue = append(q.queue, t)
+	}
+}
+
+// Must be called with lock held
+func (q *Scheduler) dequeue(t *ticket) {
+	for i, o := range q.queue {
+		if o == t {
+			q.queue = append(q.queue[:i], q.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// Must be called with lock held
+func (q *Scheduler) queued(t *ticket) bool {
+	for _, o := range q.queue {
+		if o == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the next ticket to admit. Interactive tickets go first,
+// otherwise tickets are admitted in arrival order.
+// Must be called with lock held
+func (q *Scheduler) next() *ticket {
+	if len(q.queue) == 0 {
+		return nil
+	}
+	for _, t := range q.queue {
+		if t.interactive() {
+			return t
+		}
+	}
+	return q.queue[0]
+}
+
+// Find a running background stream that can be suspended.
+// Must be called with lock held
+func (q *Scheduler) victim() *ticket {
+	for _, t := range q.tickets {
+		if t.running && !t.interactive() {
+			return t
+		}
+	}
+	return nil
+}
+
+// Admit queued streams while there are free slots. If an interactive
+// stream is still waiting, preempt background streams for it.
+// Callbacks to the streams are run in separate goroutines since the
+// caller usually holds the lock of some other stream.
+// Must be called with lock held
+func (q *Scheduler) schedule() {
+	for {
+		t := q.next()
+		if t == nil {
+			return
+		}
+
+		if q.running >= q.limit() {
+			if !t.interactive() {
+				return
+			}
+
+			v := q.victim()
+			if v == nil {
+				return
+			}
+
+			// Suspend the victim and put it back in the queue
+			v.s.logger().Info("preempted", "byManager", t.s.m.id, "byQuality", t.s.quality)
+			v.running = false
+			q.running--
+			q.enqueue(v)
+			go v.s.preempt()
+		}
+
+		q.dequeue(t)
+		t.running = true
+		q.running++
+		go t.s.admit()
+	}
+}
+
+// Called by the scheduler when a slot is granted to a queued stream.
+func (s *Stream) admit() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Stream may have been cleared in the meantime
+	if !s.m.sched.Running(s) {
+		return
+	}
+
+	// Resume a suspended coder
+	if s.coder != nil {
+		s.logger().Info("admitted, resuming transcoding", "pid", s.coder.Process.Pid)
+		s.coder.Process.Signal(syscall.SIGCONT)
+		return
+	}
+
+	// Start the pending transcode
+	if s.pending >= 0 {
+		s.logger().Info("admitted, starting transcoding", "chunk", s.pending)
+		s.startCoder(s.pending)
+		return
+	}
+
+	// Nothing to do anymore
+	s.m.sched.Release(s)
+}
+
+// Called by the scheduler when the slot of this stream was taken away.
+func (s *Stream) preempt() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// May have been readmitted already
+	if s.m.sched.Running(s) {
+		return
+	}
+
+	if s.coder != nil {
+		s.coder.Process.Signal(syscall.SIGSTOP)
+	}
+}
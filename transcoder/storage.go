@@ -0,0 +1,291 @@
+package transcoder
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Storage keeps the temp directory within Config.TempDirQuota and
+// Config.MinFreeSpace. It is shared by all managers of a Handler.
+// Usage is measured on disk, so it includes chunks still being
+// written and uploaded source files. The rest of files that are
+// still being uploaded is reserved on top of that. Under pressure
+// the oldest finished chunks of all streams are pruned; they are
+// transcoded again if they are requested later.
+type Storage struct {
+	c *Config
+
+	mutex    sync.Mutex
+	managers map[*Manager]bool
+	reserved map[string]int64 // final length of files being uploaded
+}
+
+// A finished chunk that can be pruned to free space
+type storedChunk struct {
+	s    *Stream
+	id   int
+	size int64
+	time time.Time
+}
+
+func NewStorage(c *Config) *Storage {
+	return &Storage{
+		c:        c,
+		managers: make(map[*Manager]bool),
+		reserved: make(map[string]int64),
+	}
+}
+
+// Check the limits every few seconds. The configuration
+// may be replaced at runtime, so this always runs.
+func (st *Storage) Run() {
+	t := time.NewTicker(5 * time.Second)
+	defer t.Stop()
+
+	for range t.C {
+		st.Reclaim(0)
+	}
+}
+
+func (st *Storage) Register(m *Manager) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.managers[m] = true
+}
+
+func (st *Storage) Unregister(m *Manager) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	delete(st.managers, m)
+}
+
+// Check if a manager was created for the source file
+func (st *Storage) Claimed(path string) bool {
+	// Managers have the resolved path
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		real = path
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	for m := range st.managers {
+		if m.path == path || m.path == real {
+			return true
+		}
+	}
+	return false
+}
+
+// Make room for a file that will grow to the given length, and keep
+// the room for it until Unreserve. Returns false if the limits
+// cannot be met.
+func (st *Storage) Reserve(file string, length int64) bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if !st.reclaim(length) {
+		return false
+	}
+	st.reserved[file] = length
+	return true
+}
+
+// Stop reserving room for the file, once it is complete or removed
+func (st *Storage) Unreserve(file string) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	delete(st.reserved, file)
+}
+
+// Make room for the given number of bytes, pruning chunks if needed.
+// Returns false if the limits cannot be met.
+func (st *Storage) Reclaim(need int64) bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return st.reclaim(need)
+}
+
+// Must be called with lock held.
+func (st *Storage) reclaim(need int64) bool {
+	if !st.enabled() {
+		return true
+	}
+
+	deficit := st.deficit(need)
+	if deficit <= 0 {
+		return true
+	}
+
+	// Oldest chunks first
+	chunks := st.chunks()
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].time.Before(chunks[j].time)
+	})
+
+	freed := int64(0)
+	pruned := 0
+	for _, c := range chunks {
+		if freed >= deficit {
+			break
+		}
+
+		c.s.mutex.Lock()
+		if chunk, ok := c.s.chunks[c.id]; ok && chunk.done {
+			c.s.pruneChunk(c.id)
+			freed += c.size
+			pruned++
+		}
+		c.s.mutex.Unlock()
+	}
+
+	if pruned > 0 {
+		slog.Info("pruned chunks for storage", "chunks", pruned, "bytes", freed)
+	}
+
+	// Measure again since files may be shared
+	// (single fMP4 files, segment cache links)
+	if deficit = st.deficit(need); deficit > 0 {
+		used, free := st.usage()
+		slog.Warn("not enough storage", "short", deficit, "used", used, "free", free)
+		for m := range st.managers {
+			m.logger().Info("storage usage", "bytes", m.diskUsage())
+		}
+		return false
+	}
+	return true
+}
+
+// Check if any limit is configured
+func (st *Storage) enabled() bool {
+	return st.c.TempDirQuota > 0 || st.c.MinFreeSpace > 0
+}
+
+// Number of bytes to free so that the given number of
+// bytes can be written within the limits, besides the
+// reserved files. Must be called with lock held.
+func (st *Storage) deficit(need int64) int64 {
+	used, free := st.usage()
+	need += st.reservedLeft()
+	deficit := int64(0)
+
+	if quota := int64(st.c.TempDirQuota) * 1024 * 1024; quota > 0 && used+need > quota {
+		deficit = used + need - quota
+	}
+
+	if min := int64(st.c.MinFreeSpace) * 1024 * 1024; min > 0 && free >= 0 && free-need < min {
+		if d := min - (free - need); d > deficit {
+			deficit = d
+		}
+	}
+
+	return deficit
+}
+
+// Bytes that the reserved files have yet to grow by.
+// Must be called with lock held.
+func (st *Storage) reservedLeft() int64 {
+	left := int64(0)
+	for file, length := range st.reserved {
+		size := int64(0)
+		if info, err := os.Stat(file); err == nil {
+			size = info.Size()
+		}
+		if length > size {
+			left += length - size
+		}
+	}
+	return left
+}
+
+// Get the bytes used in the temp directory and the bytes
+// available on its file system (-1 if unknown)
+func (st *Storage) usage() (int64, int64) {
+	used := dirSize(st.c.TempDir)
+
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(st.c.TempDir, &fs); err != nil {
+		return used, -1
+	}
+	return used, int64(fs.Bavail) * int64(fs.Bsize)
+}
+
+// Get the finished chunks of all streams.
+// Must be called with lock held.
+func (st *Storage) chunks() []*storedChunk {
+	chunks := make([]*storedChunk, 0)
+	for m := range st.managers {
+		for _, s := range m.streams {
+			s.mutex.Lock()
+			for id, chunk := range s.chunks {
+				if !chunk.done {
+					continue
+				}
+
+				// Chunks in a single file have the time of the file
+				filename := chunk.file
+				size := chunk.length
+				if filename == "" {
+					filename = s.getChunkPath(id)
+					size = 0
+				}
+
+				info, err := os.Stat(filename)
+				if err != nil {
+					continue
+				}
+				if size == 0 {
+					size = info.Size()
+				}
+
+				chunks = append(chunks, &storedChunk{s: s, id: id, size: size, time: info.ModTime()})
+			}
+			s.mutex.Unlock()
+		}
+	}
+	return chunks
+}
+
+// Get the bytes on disk of each stream by quality.
+// An uploaded source file is listed as "source".
+func (m *Manager) diskUsage() map[string]int64 {
+	usage := make(map[string]int64)
+
+	filepath.Walk(m.tempDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+
+		// 720p-000003.ts, 720p_fmp4-init.mp4
+		quality := strings.SplitN(info.Name(), "-", 2)[0]
+		usage[quality] += info.Size()
+		return nil
+	})
+
+	if isTemp(m.path) {
+		if info, err := os.Stat(m.path); err == nil {
+			usage["source"] = info.Size()
+		}
+	}
+
+	return usage
+}
+
+// Total size of the files in the directory
+func dirSize(dir string) int64 {
+	size := int64(0)
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
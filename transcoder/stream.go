@@ -4,13 +4,16 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -20,9 +23,17 @@ const (
 	ENCODER_X264  = "libx264"
 	ENCODER_VAAPI = "h264_vaapi"
 	ENCODER_NVENC = "h264_nvenc"
+	ENCODER_QSV   = "h264_qsv"
+
+	ENCODER_X265       = "libx265"
+	ENCODER_VAAPI_HEVC = "hevc_vaapi"
+	ENCODER_NVENC_HEVC = "hevc_nvenc"
+	ENCODER_SVTAV1     = "libsvtav1"
 
 	QUALITY_MAX = "max"
 	CODEC_H264  = "h264"
+	CODEC_HEVC  = "hevc"
+	CODEC_AV1   = "av1"
 )
 
 type Stream struct {
@@ -33,6 +44,20 @@ type Stream struct {
 	height  int
 	width   int
 	bitrate int
+	encoder Encoder
+
+	// Start times of the chunks in seconds
+	segments []float64
+	// Chunks start on keyframes of the source
+	aligned bool
+
+	// Twin of a stream segmented as fMP4 instead of MPEG-TS
+	fmp4Twin bool
+
+	// Audio track of an audio-only stream
+	audio      *ProbeAudioData
+	audioCopy  bool   // passthrough without transcoding
+	audioGroup string // group of audio renditions
 
 	goal int
 
@@ -40,7 +65,26 @@ type Stream struct {
 	chunks     map[int]*Chunk
 	seenChunks map[int]bool // only for stdout reader
 
-	coder *exec.Cmd
+	coder   *exec.Cmd
+	pending int // chunk to start at once admitted by the scheduler
+
+	// fMP4 init segment being written by the coder, and a
+	// channel that is closed once the init segment is saved
+	coderInit string
+	initReady chan bool
+
+	// Single fMP4 file of the coder (FMP4SingleFile) and
+	// the number of chunks left in each such file
+	coderFile string
+	files     map[string]int
+
+	// Last lines of stderr of the coder, and
+	// the last time a coder failed
+	stderrTail []string
+	failure    *Failure
+
+	// Hash of the source and encoding for the segment cache
+	cacheBase string
 
 	inactive int
 	stop     chan bool
@@ -84,7 +128,7 @@ func (s *Stream) Run() {
 }
 
 func (s *Stream) clear() {
-	log.Printf("%s-%s: stopping stream", s.m.id, s.quality)
+	s.logger().Info("stopping stream")
 
 	for _, chunk := range s.chunks {
 		// Delete files
@@ -94,12 +138,29 @@ func (s *Stream) clear() {
 	s.chunks = make(map[int]*Chunk)
 	s.seenChunks = make(map[int]bool)
 	s.goal = 0
+	s.pending = -1
 
 	if s.coder != nil {
 		s.coder.Process.Kill()
 		s.coder.Wait()
 		s.coder = nil
 	}
+
+	// Init segment of the coder may be incomplete
+	if s.coderInit != "" && s.coderInit != s.coderFile {
+		os.Remove(s.coderInit)
+	}
+	s.coderInit = ""
+
+	// All chunks of the single file are gone
+	if s.coderFile != "" {
+		os.Remove(s.coderFile)
+		delete(s.files, s.coderFile)
+		s.coderFile = ""
+	}
+
+	// Give up the slot or queue position
+	s.m.sched.Release(s)
 }
 
 func (s *Stream) Stop() {
@@ -113,30 +174,24 @@ func (s *Stream) ServeList(w http.ResponseWriter, r *http.Request) error {
 	WriteM3U8ContentType(w)
 	w.Write([]byte("#EXTM3U\n"))
 	
-	// Adaptive HLS version based on client capabilities
-	hlsVersion := s.c.HLSVersion
+	// Adaptive HLS version based on client capabilities,
+	// with the same container as the transcoder output
+	client := s.m.getClient()
+	hlsVersion := client.HLSVersion
+	useMP4 := s.fmp4()
 	segmentExt := "ts"
-	
-	// Check for client-specific requirements
-	userAgent := r.Header.Get("User-Agent")
-	ua := strings.ToLower(userAgent)
-	
-	// Determine optimal format based on client
-	useMP4 := s.c.EnableFMP4 && !s.c.ForceCompatibility
-	
-	// Force TS for problematic browsers/devices
-	if strings.Contains(ua, "firefox") || 
-	   strings.Contains(ua, "tv") || 
-	   strings.Contains(ua, "webview") ||
-	   s.c.LowBandwidthMode {
-		useMP4 = false
-		hlsVersion = 3 // More compatible version
+	if useMP4 {
+		segmentExt = "mp4"
+		if hlsVersion < 6 {
+			hlsVersion = 6
+		}
 	}
-	
-	// Chrome/Safari can use fMP4 for better efficiency
-	if useMP4 && (strings.Contains(ua, "chrome") || strings.Contains(ua, "safari") || strings.Contains(ua, "edge")) {
+
+	// HEVC and AV1 are always fMP4, whatever the client
+	if s.fmp4Only() {
+		useMP4 = true
 		segmentExt = "mp4"
-		hlsVersion = 6
+		hlsVersion = 7
 	}
 	
 	w.Write([]byte(fmt.Sprintf("#EXT-X-VERSION:%d\n", hlsVersion)))
@@ -148,23 +203,38 @@ func (s *Stream) ServeList(w http.ResponseWriter, r *http.Request) error {
 	
 	w.Write([]byte("#EXT-X-MEDIA-SEQUENCE:0\n"))
 	w.Write([]byte("#EXT-X-PLAYLIST-TYPE:VOD\n"))
-	w.Write([]byte(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", s.c.ChunkSize)))
 
 	query := GetQueryString(r)
 
-	duration := s.m.probe.Duration.Seconds()
-	i := 0
-	for duration > 0 {
-		size := float64(s.c.ChunkSize)
-		if duration < size {
-			size = duration
-		}
+	// Variable durations from the segment boundaries
+	w.Write([]byte(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(s.maxChunkDuration())))))
 
-		w.Write([]byte(fmt.Sprintf("#EXTINF:%.3f,\n", size)))
-		w.Write([]byte(fmt.Sprintf("%s-%06d.%s%s\n", s.quality, i, segmentExt, query)))
+	// fMP4 chunks cannot be decoded without the init segment
+	if segmentExt == "mp4" {
+		w.Write([]byte(fmt.Sprintf("#EXT-X-MAP:URI=\"%s-init.mp4%s\"\n", s.quality, query)))
+	}
+
+	// Chunks in a single file are addressed with byte ranges
+	// once they are done; the others have their own URL
+	ranges := make(map[int]*Chunk)
+	if segmentExt == "mp4" {
+		s.mutex.Lock()
+		for id, chunk := range s.chunks {
+			if chunk.done && chunk.file != "" {
+				ranges[id] = chunk
+			}
+		}
+		s.mutex.Unlock()
+	}
 
-		duration -= float64(s.c.ChunkSize)
-		i++
+	for i := range s.segments {
+		w.Write([]byte(fmt.Sprintf("#EXTINF:%.3f,\n", s.chunkEnd(i)-s.segments[i])))
+		if chunk, ok := ranges[i]; ok {
+			w.Write([]byte(fmt.Sprintf("#EXT-X-BYTERANGE:%d@%d\n", chunk.length, chunk.offset)))
+			w.Write([]byte(fmt.Sprintf("%s%s\n", filepath.Base(chunk.file), query)))
+		} else {
+			w.Write([]byte(fmt.Sprintf("%s-%06d.%s%s\n", s.quality, i, segmentExt, query)))
+		}
 	}
 
 	w.Write([]byte("#EXT-X-ENDLIST\n"))
@@ -177,6 +247,20 @@ func (s *Stream) ServeChunk(w http.ResponseWriter, id int) error {
 	defer s.mutex.Unlock()
 
 	s.inactive = 0
+
+	// Finished in an earlier session
+	if _, ok := s.chunks[id]; !ok {
+		if f, size := s.m.cache.Open(s.cacheKey(id)); f != nil {
+			// Buffer what comes after the cached chunks
+			if next := s.nextUncached(id); next < len(s.segments) {
+				s.checkGoal(next)
+			}
+
+			s.returnFile(w, &Chunk{id: id, done: true, file: f.Name(), length: size}, f)
+			return nil
+		}
+	}
+
 	s.checkGoal(id)
 
 	// Already have this chunk
@@ -213,6 +297,148 @@ func (s *Stream) ServeChunk(w http.ResponseWriter, id int) error {
 	return nil
 }
 
+// Serve the fMP4 init segment. The first init segment written by any
+// coder is kept for the lifetime of the stream, since all coders use
+// the same encoding parameters. If there is none yet, start
+// transcoding from the beginning and wait for it.
+func (s *Stream) ServeInit(w http.ResponseWriter) error {
+	s.mutex.Lock()
+	s.inactive = 0
+	filename := s.getInitPath()
+
+	// Read from the cache right away, since it may be evicted
+	var content []byte
+	if _, err := os.Stat(filename); err != nil {
+		if f, _ := s.m.cache.Open(s.cacheKey(-1)); f != nil {
+			if data, err := ioutil.ReadAll(f); err == nil {
+				content = data
+			}
+			f.Close()
+		}
+	}
+
+	if _, err := os.Stat(filename); err != nil && content == nil {
+		if s.coder == nil && s.pending == -1 {
+			s.createChunk(0)
+			s.goal = s.c.GoalBufferMax
+			s.transcode(0)
+		}
+
+		ready := s.getInitReady()
+		s.m.sched.Block(s)
+		s.mutex.Unlock()
+
+		t := time.NewTimer(30 * time.Second)
+		select {
+		case <-ready:
+			t.Stop()
+		case <-t.C:
+		}
+
+		s.mutex.Lock()
+		s.m.sched.Unblock(s)
+	}
+	failure := s.failure
+	if failure != nil && failure.coder != s.coder {
+		failure = nil
+	}
+	s.mutex.Unlock()
+
+	var err error
+	if content == nil {
+		content, err = ioutil.ReadFile(filename)
+	}
+	if err != nil {
+		if failure != nil {
+			writeChunkError(w, http.StatusInternalServerError, failure.Reason, failure)
+			return nil
+		}
+		atomic.AddInt64(&metrics.timeouts, 1)
+		writeChunkError(w, http.StatusRequestTimeout, FAILURE_TIMEOUT, nil)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Write(content)
+	return nil
+}
+
+// Get the channel that is closed once the init segment is saved.
+// Must be called with lock held.
+func (s *Stream) getInitReady() chan bool {
+	if s.initReady == nil {
+		s.initReady = make(chan bool)
+	}
+	return s.initReady
+}
+
+// Save the init segment of the coder once its first chunk is done,
+// when the init segment is known to be complete. Later coders write
+// to their own file which is discarded, so the saved init segment
+// never changes while clients may be reading it. In single file mode
+// the init segment is the given range of the coder file and copied.
+// Must be called with lock held.
+func (s *Stream) saveInit(r *byteRange) {
+	if s.coderInit == "" {
+		return
+	}
+
+	filename := s.getInitPath()
+	if _, err := os.Stat(filename); err == nil {
+		if r == nil {
+			os.Remove(s.coderInit)
+		}
+	} else {
+		var err error
+		if r != nil {
+			err = copyRange(s.coderInit, filename, r)
+		} else {
+			err = os.Rename(s.coderInit, filename)
+		}
+
+		if err != nil {
+			s.logger().Error("could not save init segment", "err", err)
+		} else {
+			close(s.getInitReady())
+			go s.m.cache.Put(s.cacheKey(-1), filename, nil)
+		}
+	}
+
+	s.coderInit = ""
+}
+
+// Serve HTTP range requests for a single file of this stream
+func (s *Stream) ServeFile(w http.ResponseWriter, r *http.Request, name string) error {
+	s.mutex.Lock()
+	s.inactive = 0
+
+	// Only files with chunks can be requested
+	filename := ""
+	for file, count := range s.files {
+		if filepath.Base(file) == name && count > 0 {
+			filename = file
+		}
+	}
+	s.mutex.Unlock()
+
+	if filename == "" {
+		// File was removed after the playlist was served
+		w.WriteHeader(http.StatusConflict)
+		return nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		return nil
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "video/mp4")
+	http.ServeContent(w, r, name, time.Time{}, f)
+	return nil
+}
+
 func (s *Stream) ServeFullVideo(w http.ResponseWriter, r *http.Request) error {
 	args := s.transcodeArgs(0, false)
 
@@ -229,23 +455,26 @@ func (s *Stream) ServeFullVideo(w http.ResponseWriter, r *http.Request) error {
 	}...)
 
 	coder := exec.Command(s.c.FFmpeg, args...)
-	log.Printf("%s-%s: %s", s.m.id, s.quality, strings.Join(coder.Args[:], " "))
+	logger := s.logger()
+	logger.Info("starting full video", "args", strings.Join(coder.Args[:], " "))
 
 	cmdStdOut, err := coder.StdoutPipe()
 	if err != nil {
-		log.Printf("FATAL: ffmpeg command stdout failed with %s\n", err)
+		logger.Error("could not get ffmpeg stdout", "err", err)
 	}
 
 	cmdStdErr, err := coder.StderrPipe()
 	if err != nil {
-		log.Printf("FATAL: ffmpeg command stdout failed with %s\n", err)
+		logger.Error("could not get ffmpeg stderr", "err", err)
 	}
 
 	err = coder.Start()
 	if err != nil {
-		log.Printf("FATAL: ffmpeg command failed with %s\n", err)
+		logger.Error("could not start ffmpeg", "err", err)
+	} else {
+		logger = logger.With("pid", coder.Process.Pid)
 	}
-	go s.monitorStderr(cmdStdErr)
+	go s.monitorStderr(cmdStdErr, coder, nil)
 
 	// Write to response
 	defer cmdStdOut.Close()
@@ -269,14 +498,13 @@ func (s *Stream) ServeFullVideo(w http.ResponseWriter, r *http.Request) error {
 			if err == io.EOF {
 				break
 			}
-			log.Printf("FATAL: ffmpeg command failed with %s\n", err)
+			logger.Error("could not read ffmpeg output", "err", err)
 			break
 		}
 
 		_, err = w.Write(buf[:n])
 		if err != nil {
-			log.Printf("%s-%s: client closed connection", s.m.id, s.quality)
-			log.Println(err)
+			logger.Info("client closed connection", "err", err)
 			break
 		}
 		flusher.Flush()
@@ -299,20 +527,31 @@ func (s *Stream) createChunk(id int) *Chunk {
 }
 
 func (s *Stream) pruneChunk(id int) {
+	chunk := s.chunks[id]
 	delete(s.chunks, id)
 
+	// Remove the single file with its last chunk,
+	// unless the coder is still writing to it
+	if chunk != nil && chunk.file != "" {
+		s.files[chunk.file]--
+		if s.files[chunk.file] <= 0 && chunk.file != s.coderFile {
+			delete(s.files, chunk.file)
+			os.Remove(chunk.file)
+		}
+		return
+	}
+
 	// Remove file
-	filename := s.getTsPath(id)
+	filename := s.getChunkPath(id)
 	os.Remove(filename)
 }
 
 func (s *Stream) returnChunk(w http.ResponseWriter, chunk *Chunk) {
-	// This function is called with lock, but we don't need it
-	s.mutex.Unlock()
-	defer s.mutex.Lock()
-
 	// Read file and write to response (support both TS and MP4)
 	filename := s.getChunkPath(chunk.id)
+	if chunk.file != "" {
+		filename = chunk.file
+	}
 	
 	// Use memory mapping for large files if enabled
 	if s.c.EnableMemoryMapping {
@@ -323,14 +562,22 @@ func (s *Stream) returnChunk(w http.ResponseWriter, chunk *Chunk) {
 	
 	f, err := os.Open(filename)
 	if err != nil {
-		log.Println(err)
+		s.logger().Error("could not open chunk", "chunk", chunk.id, "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	s.returnFile(w, chunk, f)
+}
+
+// Write an open chunk file to the response and close it.
+// Called with lock held, which is released while writing.
+func (s *Stream) returnFile(w http.ResponseWriter, chunk *Chunk, f *os.File) {
+	s.mutex.Unlock()
+	defer s.mutex.Lock()
 	defer f.Close()
-	
+
 	// Set appropriate content type based on file extension
-	if strings.HasSuffix(filename, ".mp4") {
+	if strings.HasSuffix(f.Name(), ".mp4") {
 		w.Header().Set("Content-Type", "video/mp4")
 	} else {
 		w.Header().Set("Content-Type", "video/MP2T")
@@ -345,10 +592,17 @@ func (s *Stream) returnChunk(w http.ResponseWriter, chunk *Chunk) {
 		bufferSize = 512 * 1024 // Maximum 512KB
 	}
 	
+	// Only the range of the chunk in a single file
+	var reader io.Reader = f
+	if chunk.file != "" {
+		reader = io.NewSectionReader(f, chunk.offset, chunk.length)
+	}
+
 	buf := make([]byte, bufferSize)
-	_, err = io.CopyBuffer(w, f, buf)
+	n, err := io.CopyBuffer(w, reader, buf)
+	atomic.AddInt64(&metrics.bytes, n)
 	if err != nil {
-		log.Printf("%s-%s: error serving chunk %d: %v", s.m.id, s.quality, chunk.id, err)
+		s.logger().Warn("error serving chunk", "chunk", chunk.id, "err", err)
 	}
 }
 
@@ -358,21 +612,32 @@ func (s *Stream) waitForChunk(w http.ResponseWriter, chunk *Chunk) {
 		return
 	}
 
+	// The coder already failed; nothing is coming
+	if f := s.failure; f != nil && s.coder != nil && f.coder == s.coder {
+		writeChunkError(w, http.StatusInternalServerError, f.Reason, f)
+		return
+	}
+
 	// Add our channel
 	notif := make(chan bool)
 	chunk.notifs = append(chunk.notifs, notif)
 	t := time.NewTimer(30 * time.Second)  // Increased for high bitrate content
 	coder := s.coder
 
+	// Get priority with the scheduler while we wait
+	s.m.sched.Block(s)
 	s.mutex.Unlock()
 
+	start := time.Now()
 	select {
 	case <-notif:
 		t.Stop()
 	case <-t.C:
 	}
+	metrics.chunkWait.Observe(time.Since(start))
 
 	s.mutex.Lock()
+	s.m.sched.Unblock(s)
 
 	// remove channel
 	for i, c := range chunk.notifs {
@@ -388,19 +653,28 @@ func (s *Stream) waitForChunk(w http.ResponseWriter, chunk *Chunk) {
 		return
 	}
 
+	// ffmpeg failed, tell the client why
+	if f := s.failure; f != nil && f.coder == coder && f.Fallback == "" {
+		writeChunkError(w, http.StatusInternalServerError, f.Reason, f)
+		return
+	}
+
 	// Check if coder was changed
 	if coder != s.coder {
-		w.WriteHeader(http.StatusConflict)
+		atomic.AddInt64(&metrics.conflicts, 1)
+		writeChunkError(w, http.StatusConflict, FAILURE_RESTARTED, nil)
 		return
 	}
 
 	// Return timeout error
-	w.WriteHeader(http.StatusRequestTimeout)
+	atomic.AddInt64(&metrics.timeouts, 1)
+	writeChunkError(w, http.StatusRequestTimeout, FAILURE_TIMEOUT, nil)
 }
 
 func (s *Stream) restartAtChunk(w http.ResponseWriter, id int) {
 	// Stop current transcoder
 	s.clear()
+	atomic.AddInt64(&metrics.restarts, 1)
 
 	chunk := s.createChunk(id) // create first chunk
 
@@ -417,31 +691,29 @@ func (s *Stream) transcodeArgs(startAt float64, isHls bool) []string {
 		"-loglevel", "warning",
 	}
 
-	if startAt > 0 {
+	if startAt > 0 && s.aligned {
+		// The chunk starts on a keyframe of the source. Input seeking
+		// goes to the keyframe before the given time, so seek just
+		// past it and start there without decoding anything before.
+		args = append(args, []string{
+			"-noaccurate_seek",
+			"-ss", fmt.Sprintf("%.6f", startAt+0.001),
+		}...)
+	} else if startAt > 0 {
 		args = append(args, []string{
 			"-ss", fmt.Sprintf("%.6f", startAt),
 		}...)
 	}
 
-	// encoder selection with hardware optimization
-	CV := ENCODER_X264
-
-	// Check whether hwaccel should be used
-	if s.c.VAAPI {
-		CV = ENCODER_VAAPI
-		extra := "-hwaccel vaapi -hwaccel_device /dev/dri/renderD128 -hwaccel_output_format vaapi"
-		args = append(args, strings.Split(extra, " ")...)
-	} else if s.c.NVENC {
-		CV = ENCODER_NVENC
-		// Enhanced CUDA acceleration with device selection
-		extra := fmt.Sprintf("-hwaccel cuda -hwaccel_device %d", s.c.CUDADevice)
-		
-		// Don't use hwaccel_output_format cuda - it causes filter chain issues
-		// Let frames stay in system memory and use hwupload_cuda in the filter
-		
-		args = append(args, strings.Split(extra, " ")...)
+	// Audio-only streams have no video
+	if s.audio != nil {
+		return append(args, s.audioArgs()...)
 	}
 
+	// Encoder backend of this stream
+	enc := s.encoder
+	args = append(args, enc.InputArgs(s)...)
+
 	// Disable autorotation (see transpose comments below)
 	if s.c.UseTranspose {
 		args = append(args, []string{"-noautorotate"}...)
@@ -454,66 +726,21 @@ func (s *Stream) transcodeArgs(startAt float64, isHls bool) []string {
 		"-fflags", "+genpts",
 	}...)
 
-	// Filters
-	format := "format=nv12"
-	scaler := "scale"
-	scalerArgs := make([]string, 0)
-	scalerArgs = append(scalerArgs, "force_original_aspect_ratio=decrease")
-
-	if CV == ENCODER_VAAPI {
-		format = "format=nv12|vaapi,hwupload"
-		scaler = "scale_vaapi"
-		scalerArgs = append(scalerArgs, "format=nv12")
-	} else if CV == ENCODER_NVENC {
-		// Use NPP for better performance (your FFmpeg supports it)
-		format = "format=nv12,hwupload_cuda"
-		
-		// Use appropriate scaler based on NVENCScale setting
-		if s.c.NVENCScale == "npp" {
-			scaler = "scale_npp"
-		} else if s.c.NVENCScale == "cuda" {
-			scaler = "scale_cuda"
-			// workaround to force scale_cuda to examine all input frames
-			scalerArgs = append(scalerArgs, "passthrough=0")
-		} else {
-			// fallback to basic scale
-			scaler = "scale"
-		}
-	}
-
-	// Scale height and width if not max quality
-	if s.quality != QUALITY_MAX {
-		// Proper aspect ratio scaling - avoid creating squares!
-		scalerArgs = append(scalerArgs, fmt.Sprintf("w=%d", s.width))
-		scalerArgs = append(scalerArgs, fmt.Sprintf("h=%d", s.height))
-	}
-
 	// Apply filter
-	if CV != ENCODER_COPY {
-		filter := fmt.Sprintf("%s,%s=%s", format, scaler, strings.Join(scalerArgs, ":"))
-
+	if filter := enc.Filter(s); filter != "" {
 		// Rotation is a mess: https://trac.ffmpeg.org/ticket/8329
 		//   1/ -noautorotate copies the sidecar metadata to the output
 		//   2/ autorotation doesn't seem to work with some types of HW (at least not with VAAPI)
 		//   3/ autorotation doesn't work with HLS streams
 		//   4/ VAAPI cannot transport on AMD GPUs
 		// So: give the user to disable autorotation for HLS and use a manual transpose
-		if isHls && s.c.UseTranspose {
-			transposer := "transpose"
-			if CV == ENCODER_VAAPI {
-				transposer = "transpose_vaapi"
-			} else if CV == ENCODER_NVENC {
-				transposer = fmt.Sprintf("transpose_%s", s.c.NVENCScale)
-			}
-
-			if transposer != "transpose_cuda" { // does not exist
-				if s.m.probe.Rotation == -90 {
-					filter = fmt.Sprintf("%s,%s=1", filter, transposer)
-				} else if s.m.probe.Rotation == 90 {
-					filter = fmt.Sprintf("%s,%s=2", filter, transposer)
-				} else if s.m.probe.Rotation == 180 || s.m.probe.Rotation == -180 {
-					filter = fmt.Sprintf("%s,%s=1,%s=1", filter, transposer, transposer)
-				}
+		if transposer := enc.Transposer(s); isHls && s.c.UseTranspose && transposer != "" {
+			if s.m.probe.Rotation == -90 {
+				filter = fmt.Sprintf("%s,%s=1", filter, transposer)
+			} else if s.m.probe.Rotation == 90 {
+				filter = fmt.Sprintf("%s,%s=2", filter, transposer)
+			} else if s.m.probe.Rotation == 180 || s.m.probe.Rotation == -180 {
+				filter = fmt.Sprintf("%s,%s=1,%s=1", filter, transposer, transposer)
 			}
 		}
 
@@ -523,174 +750,105 @@ func (s *Stream) transcodeArgs(startAt float64, isHls bool) []string {
 	// Output specs for video
 	args = append(args, []string{
 		"-map", "0:v:0",
-		"-c:v", CV,
+		"-c:v", enc.Codec(),
 	}...)
 
 	// Device specific output args
-	if CV == ENCODER_VAAPI {
-		args = append(args, []string{"-global_quality", fmt.Sprintf("%d", s.c.QF)}...)
+	args = append(args, enc.OutputArgs(s)...)
 
-		if s.c.VAAPILowPower {
-			args = append(args, []string{"-low_power", "1"}...)
-		}
-	} else if CV == ENCODER_NVENC {
-		// Adaptive encoding complexity based on content and hardware
-		preset := "p4"  // Default balanced preset
-		tune := "hq"    // Default high quality
-		lookahead := 60 // Default lookahead
-		
-		// Adjust based on content complexity and adaptive settings
-		if s.c.AdaptiveComplexity {
-			// Special handling for very demanding content
-			if s.m.probe.BitRate > 100000000 { // >100Mbps: extremely high complexity
-				preset = "p2" // Slowest preset for demanding content
-				lookahead = 250 // Maximum lookahead for best prediction
-				tune = "hq" // High quality mode
-			} else if s.m.probe.BitRate > 50000000 { // >50Mbps: very high complexity
-				preset = "p3" // Slower preset for high bitrate
-				lookahead = 120 // Extended lookahead
-			} else if s.m.probe.BitRate > 20000000 { // >20Mbps: high complexity
-				preset = "p4" // Balanced for moderate high bitrate
-				lookahead = 80
-			}
-			
-			// Special handling for high framerate content (>30fps)
-			if s.m.probe.FrameRate > 30 {
-				lookahead = int(float64(lookahead) * 1.5) // Increase lookahead for HFR
-				if s.m.probe.FrameRate >= 50 { // 50fps+ (like deinterlaced content)
-					preset = "p3" // Use slower preset for very high framerate
-					if lookahead > 250 {
-						lookahead = 250 // Cap at maximum
-					}
-				}
-			}
-			
-			// For lower qualities, prioritize speed but not at expense of stability
-			if s.quality == "480p" {
-				if s.m.probe.BitRate > 50000000 {
-					preset = "p5" // Don't go too fast for complex content
-					lookahead = 40
-				} else {
-					preset = "p7" // Fastest for simple low quality
-					tune = "ll"   // Low latency
-					lookahead = 20
-				}
-			} else if s.quality == "720p" {
-				if s.m.probe.BitRate > 50000000 {
-					preset = "p4" // Slower for complex 720p
-					lookahead = 60
-				} else {
-					preset = "p6"
-					lookahead = 30
-				}
-			}
-		}
-		
-		// GPU-specific optimizations
-		args = append(args, []string{
-			"-gpu", fmt.Sprintf("%d", s.c.CUDADevice),
-			"-preset", preset,
-			"-tune", tune,
-			"-rc", "vbr",
-			"-rc-lookahead", fmt.Sprintf("%d", lookahead),
-			"-multipass", "fullres",   // Better quality for demanding content
-			"-cq", fmt.Sprintf("%d", s.c.QF),
-		}...)
+	// Audio output specs. For HLS, audio tracks are separate streams.
+	if isHls || len(s.m.probe.Audio) == 0 {
+		args = append(args, "-an")
+	} else {
+		audio := &Stream{c: s.c, m: s.m, audio: s.m.probe.Audio[0]}
+		audio.bitrate = audio.audioBitrate(s.c.AudioBitrates[s.quality])
 
-		// Advanced NVENC features
-		if s.c.NVENCTemporalAQ {
-			args = append(args, []string{"-temporal-aq", "1"}...)
-		}
-		
-		// GPU memory management (removed incompatible option)
-		// Note: -gpu_memory_limit not supported in all FFmpeg versions
-
-		// Add rate control aligned with advertised bandwidth
-		// This prevents encoder overshoot that causes rebuffering
-		if s.quality != QUALITY_MAX {
-			target := s.bitrate
-			maxrate := int(float64(target) * 1.25)  // Allow 25% burst
-			bufsize := maxrate * 2                   // 2 second buffer
-			args = append(args, []string{
-				"-maxrate", fmt.Sprintf("%d", maxrate),
-				"-bufsize", fmt.Sprintf("%d", bufsize),
-			}...)
-		}
-	} else if CV == ENCODER_X264 {
-		args = append(args, []string{
-			"-preset", "faster",
-			"-crf", fmt.Sprintf("%d", s.c.QF),
-		}...)
+		args = append(args, []string{"-map", "0:a:0"}...)
+		args = append(args, audio.audioEncodeArgs()...)
 	}
 
-	// Audio output specs
-	args = append(args, []string{
-		"-map", "0:a:0?",
-		"-c:a", "aac",
-		"-ac", "1",
-	}...)
-
 	return args
 }
 
+// Start transcoding at the given chunk as soon as the scheduler
+// has a free slot. Must be called with lock held.
 func (s *Stream) transcode(startId int) {
-	if startId > 0 {
-		// Start one frame before
-		// This ensures that the keyframes are aligned
-		startId--
+	s.pending = startId
+	if !s.m.sched.Request(s) {
+		s.logger().Info("queued transcoding", "chunk", startId)
+		return
 	}
-	startAt := float64(startId * s.c.ChunkSize)
+	s.startCoder(startId)
+}
 
+// Start the ffmpeg process. Must be called with lock held
+// and after a slot was granted by the scheduler.
+func (s *Stream) startCoder(startId int) {
+	s.pending = -1
+
+	startAt := s.chunkStart(startId)
 	args := s.transcodeArgs(startAt, true)
 
 	// Adaptive segmenting specs based on configuration and client support
 	segmentType := "mpegts"
 	segmentExt := "ts"
-	hlsFlags := "split_by_time"  // Use split_by_time only for compatibility
-	
-	// Use fMP4 for modern browsers if enabled
-	if s.c.EnableFMP4 && !s.c.ForceCompatibility {
+	hlsFlags := []string{"split_by_time"} // Use split_by_time only for compatibility
+	hlsTime := fmt.Sprintf("%d", s.c.ChunkSize)
+
+	// Split only on the keyframes at chunk boundaries.
+	// split_by_time would cut in the middle of a GOP.
+	if s.aligned {
+		hlsFlags = []string{}
+	}
+
+	// Split on every keyframe of the source when copying
+	if s.audio == nil && s.encoder.Codec() == ENCODER_COPY {
+		hlsTime = fmt.Sprintf("%.6f", s.minChunkDuration()/2)
+	}
+
+	// fMP4 chunks are separate files sharing an init segment,
+	// so they can be picked up like TS chunks and used for DASH
+	segmentFilename := s.getSegmentPath(-1, segmentExt)
+	if s.fmp4() {
 		segmentType = "fmp4"
 		segmentExt = "mp4"
-		hlsFlags += "+single_file" // Enable single file mode for fMP4
-	}
-	
-	// Force TS for compatibility mode or low bandwidth
-	if s.c.ForceCompatibility || s.c.LowBandwidthMode {
-		segmentType = "mpegts"
-		segmentExt = "ts"
-		hlsFlags = "split_by_time"  // Remove conflicting independent_segments flag
+		segmentFilename = s.getSegmentPath(-1, segmentExt)
+
+		if s.c.FMP4SingleFile {
+			// One file for the coder starting with the init segment.
+			// The previous file is removed with its last chunk.
+			if s.coderFile != "" && s.files[s.coderFile] == 0 {
+				os.Remove(s.coderFile)
+			}
+			if s.files == nil {
+				s.files = make(map[string]int)
+			}
+			s.coderFile = s.getCoderFilePath(startId)
+			s.coderInit = s.coderFile
+			segmentFilename = s.coderFile
+			hlsFlags = append(hlsFlags, "single_file")
+		} else {
+			s.coderInit = s.getCoderInitPath(startId)
+			args = append(args, []string{"-hls_fmp4_init_filename", s.coderInit}...)
+		}
 	}
-	
+
 	args = append(args, []string{
 		"-start_number", fmt.Sprintf("%d", startId),
 		"-avoid_negative_ts", "disabled",
 		"-f", "hls",
-		"-hls_flags", hlsFlags,
-		"-hls_time", fmt.Sprintf("%d", s.c.ChunkSize),
+		"-hls_time", hlsTime,
 		"-hls_segment_type", segmentType,
-		"-hls_segment_filename", s.getSegmentPath(-1, segmentExt),
+		"-hls_segment_filename", segmentFilename,
 	}...)
 
+	if len(hlsFlags) > 0 {
+		args = append(args, []string{"-hls_flags", strings.Join(hlsFlags, "+")}...)
+	}
+
 	// Keyframe specs - enhanced for complex content
-	if s.c.UseGopSize && s.m.probe.FrameRate > 0 {
-		// Fix GOP size
-		args = append(args, []string{
-			"-g", fmt.Sprintf("%d", s.c.ChunkSize*s.m.probe.FrameRate),
-			"-keyint_min", fmt.Sprintf("%d", s.c.ChunkSize*s.m.probe.FrameRate),
-		}...)
-	} else {
-		// Force keyframes every chunk - enhanced for edited content
-		args = append(args, []string{
-			"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", s.c.ChunkSize),
-		}...)
-		
-		// For NVENC, add extra options to handle complex edited content
-		if s.c.NVENC {
-			args = append(args, []string{
-				"-forced-idr", "1",  // Force IDR frames for better seeking
-			}...)
-		}
+	if s.audio == nil {
+		args = append(args, s.encoder.KeyframeArgs(s, startId)...)
 	}
 
 	// Output to stdout
@@ -709,26 +867,37 @@ func (s *Stream) transcode(startId int) {
 			quotedArgs[i] = arg
 		}
 	}
-	log.Printf("%s-%s: %s", s.m.id, s.quality, strings.Join(quotedArgs[:], " "))
+	logger := s.logger().With("chunk", startId)
+	logger.Info("starting transcoding", "args", strings.Join(quotedArgs[:], " "))
 
 	cmdStdOut, err := s.coder.StdoutPipe()
 	if err != nil {
-		log.Printf("FATAL: ffmpeg command stdout failed with %s\n", err)
+		logger.Error("could not get ffmpeg stdout", "err", err)
 	}
 
 	cmdStdErr, err := s.coder.StderrPipe()
 	if err != nil {
-		log.Printf("FATAL: ffmpeg command stdout failed with %s\n", err)
+		logger.Error("could not get ffmpeg stderr", "err", err)
 	}
 
+	s.stderrTail = nil
 	err = s.coder.Start()
 	if err != nil {
-		log.Printf("FATAL: ffmpeg command failed with %s\n", err)
+		logger.Error("could not start ffmpeg", "err", err)
+	} else {
+		logger.Debug("ffmpeg started", "pid", s.coder.Process.Pid)
 	}
 
-	go s.monitorTranscodeOutput(cmdStdOut, startAt)
-	go s.monitorStderr(cmdStdErr)
-	go s.monitorExit()
+	stdoutDone := make(chan bool)
+	go s.monitorTranscodeOutput(cmdStdOut, startAt, stdoutDone)
+	stderrDone := make(chan bool)
+	go s.monitorStderr(cmdStdErr, s.coder, stderrDone)
+	go s.monitorExit(s.coder, stdoutDone, stderrDone)
+}
+
+// Check if the chunks of this stream are fMP4 instead of MPEG-TS
+func (s *Stream) fmp4() bool {
+	return s.fmp4Twin || s.fmp4Only()
 }
 
 func (s *Stream) checkGoal(id int) {
@@ -758,16 +927,17 @@ func (s *Stream) checkGoal(id int) {
 	if goal > s.goal {
 		s.goal = id + goalBufferMax
 
-		// resume encoding
-		if s.coder != nil {
-			log.Printf("%s-%s: resuming transcoding (adaptive buffer: %d-%d)", s.m.id, s.quality, goalBufferMin, goalBufferMax)
+		// resume encoding (or wait for the scheduler to resume it)
+		if s.coder != nil && s.m.sched.Request(s) {
+			s.logger().Info("resuming transcoding", "bufferMin", goalBufferMin, "bufferMax", goalBufferMax)
 			s.coder.Process.Signal(syscall.SIGCONT)
 		}
 	}
 	
 	// For demanding content, be much more aggressive about staying ahead
-	chunksAhead := 0
-	for i := id; i <= id+goalBufferMax; i++ {
+	chunksAhead, chunksLeft := 0, 0
+	for i := id; i <= id+goalBufferMax && i < len(s.segments); i++ {
+		chunksLeft++
 		if chunk, ok := s.chunks[i]; ok && chunk.done {
 			chunksAhead++
 		}
@@ -780,10 +950,15 @@ func (s *Stream) checkGoal(id int) {
 	} else if s.m.probe.BitRate > 50000000 || s.m.probe.FrameRate >= 50 {
 		restartThreshold = int(float64(goalBufferMax) * 0.6) // Keep 60% ahead
 	}
+
+	// Nothing to do if the rest of the video is done
+	if restartThreshold > chunksLeft {
+		restartThreshold = chunksLeft
+	}
 	
-	if chunksAhead < restartThreshold && s.coder == nil {
-		log.Printf("%s-%s: proactively restarting for chunk %d (%d/%d chunks ahead, bitrate: %dMbps, fps: %d)", 
-			s.m.id, s.quality, id, chunksAhead, goalBufferMax, s.m.probe.BitRate/1000000, s.m.probe.FrameRate)
+	if chunksAhead < restartThreshold && s.coder == nil && s.pending == -1 {
+		s.logger().Info("proactively restarting", "chunk", id, "ahead", chunksAhead, "bufferMax", goalBufferMax,
+			"bitrate", s.m.probe.BitRate, "fps", s.m.probe.FrameRate)
 		
 		// Start transcoding immediately in this thread for demanding content
 		if s.m.probe.BitRate > 50000000 || s.m.probe.FrameRate >= 50 {
@@ -794,7 +969,7 @@ func (s *Stream) checkGoal(id int) {
 			go func() {
 				s.mutex.Lock()
 				defer s.mutex.Unlock()
-				if s.coder == nil { // Double-check we still need to start
+				if s.coder == nil && s.pending == -1 { // Double-check we still need to start
 					s.goal = id + goalBufferMax
 					s.transcode(id)
 				}
@@ -803,6 +978,39 @@ func (s *Stream) checkGoal(id int) {
 	}
 }
 
+// Duration of the longest chunk in seconds
+func (s *Stream) maxChunkDuration() float64 {
+	max := 0.0
+	for i := range s.segments {
+		max = math.Max(max, s.chunkEnd(i)-s.segments[i])
+	}
+	return max
+}
+
+// Start time of a chunk in seconds
+func (s *Stream) chunkStart(id int) float64 {
+	if id < len(s.segments) {
+		return s.segments[id]
+	}
+	return s.m.probe.Duration.Seconds()
+}
+
+// End time of a chunk in seconds
+func (s *Stream) chunkEnd(id int) float64 {
+	return math.Min(s.chunkStart(id+1), s.m.probe.Duration.Seconds())
+}
+
+// Duration of the shortest chunk in seconds
+func (s *Stream) minChunkDuration() float64 {
+	min := float64(s.c.ChunkSize)
+	for i := range s.segments {
+		if d := s.chunkEnd(i) - s.segments[i]; d > 0 && d < min {
+			min = d
+		}
+	}
+	return min
+}
+
 func (s *Stream) getTsPath(id int) string {
 	if id == -1 {
 		return fmt.Sprintf("%s/%s-%%06d.ts", s.m.tempDir, s.quality)
@@ -817,6 +1025,18 @@ func (s *Stream) getSegmentPath(id int, ext string) string {
 	return fmt.Sprintf("%s/%s-%06d.%s", s.m.tempDir, s.quality, id, ext)
 }
 
+func (s *Stream) getInitPath() string {
+	return fmt.Sprintf("%s/%s-init.mp4", s.m.tempDir, s.quality)
+}
+
+func (s *Stream) getCoderInitPath(startId int) string {
+	return fmt.Sprintf("%s/%s-init-%06d.mp4", s.m.tempDir, s.quality, startId)
+}
+
+func (s *Stream) getCoderFilePath(startId int) string {
+	return fmt.Sprintf("%s/%s-file-%06d.mp4", s.m.tempDir, s.quality, startId)
+}
+
 func (s *Stream) getChunkPath(id int) string {
 	// Try both extensions for compatibility
 	tsPath := s.getTsPath(id)
@@ -834,15 +1054,23 @@ func (s *Stream) getChunkPath(id int) string {
 	return tsPath
 }
 
-// Separate goroutine
-func (s *Stream) monitorTranscodeOutput(cmdStdOut io.ReadCloser, startAt float64) {
+// Separate goroutine. The done channel is closed at the end of stdout.
+func (s *Stream) monitorTranscodeOutput(cmdStdOut io.ReadCloser, startAt float64, done chan bool) {
+	defer close(done)
+
 	s.mutex.Lock()
 	coder := s.coder
+	file := s.coderFile
 	s.mutex.Unlock()
 
 	defer cmdStdOut.Close()
 	stdoutReader := bufio.NewReader(cmdStdOut)
 
+	// In single file mode, chunks are numbered by their position
+	// in the playlist and have the byte range of the preceding tag
+	seq, pos := 0, 0
+	var initRange, chunkRange *byteRange
+
 	for {
 		if s.coder != coder {
 			break
@@ -854,7 +1082,7 @@ func (s *Stream) monitorTranscodeOutput(cmdStdOut io.ReadCloser, startAt float64
 				break
 			}
 		} else if err != nil {
-			log.Println(err)
+			s.logger().Error("could not read ffmpeg output", "err", err)
 			break
 		} else {
 			line = line[:(len(line) - 1)]
@@ -862,13 +1090,40 @@ func (s *Stream) monitorTranscodeOutput(cmdStdOut io.ReadCloser, startAt float64
 
 		l := string(line)
 
-		if strings.Contains(l, ".ts") {
-			// 1080p-000003.ts
-			idx := strings.Split(strings.Split(l, "-")[1], ".")[0]
+		// The whole playlist is written again for every chunk
+		if strings.HasPrefix(l, "#EXTM3U") {
+			pos = 0
+		} else if strings.HasPrefix(l, "#EXT-X-MEDIA-SEQUENCE:") {
+			seq = atoiOrZero(strings.TrimPrefix(l, "#EXT-X-MEDIA-SEQUENCE:"))
+		} else if strings.HasPrefix(l, "#EXT-X-BYTERANGE:") {
+			chunkRange = parseByteRange(strings.TrimPrefix(l, "#EXT-X-BYTERANGE:"))
+		} else if strings.HasPrefix(l, "#EXT-X-MAP:") {
+			// #EXT-X-MAP:URI="720p-file-000000.mp4",BYTERANGE="812@0"
+			if idx := strings.Index(l, "BYTERANGE=\""); idx >= 0 {
+				initRange = parseByteRange(strings.Trim(l[idx+len("BYTERANGE="):], "\""))
+			}
+		}
+
+		// Tags such as EXT-X-MAP are not chunks
+		if strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		if strings.Contains(l, ".ts") || strings.Contains(l, ".mp4") {
+			// 1080p-000003.ts or 1080p_hevc-000003.mp4
+			idx := strings.Split(l[strings.LastIndex(l, "-")+1:], ".")[0]
 			id, err := strconv.Atoi(idx)
 			if err != nil {
-				log.Println("Error parsing chunk id")
+				s.logger().Warn("could not parse chunk id", "line", l)
+			}
+
+			// 1080p-file-000003.mp4 with a byte range
+			r := chunkRange
+			if file != "" {
+				id = seq + pos
+				pos++
 			}
+			chunkRange = nil
 
 			if s.seenChunks[id] {
 				continue
@@ -876,7 +1131,7 @@ func (s *Stream) monitorTranscodeOutput(cmdStdOut io.ReadCloser, startAt float64
 			s.seenChunks[id] = true
 
 			// Debug
-			log.Printf("%s-%s: recv %s", s.m.id, s.quality, l)
+			s.logger().Debug("received chunk", "chunk", id, "file", l)
 
 			func() {
 				s.mutex.Lock()
@@ -893,23 +1148,57 @@ func (s *Stream) monitorTranscodeOutput(cmdStdOut io.ReadCloser, startAt float64
 					return
 				}
 				chunk.done = true
+
+				// Chunk is a range of the single file
+				if file != "" && r != nil {
+					chunk.file = file
+					chunk.offset = r.offset
+					chunk.length = r.length
+					s.files[file]++
+				}
+
+				// Keep the chunk for later sessions
+				if file == "" {
+					go s.m.cache.Put(s.cacheKey(id), s.getChunkPath(id), nil)
+				} else if r != nil {
+					go s.m.cache.Put(s.cacheKey(id), file, r)
+				}
+
 				for _, n := range chunk.notifs {
 					n <- true
 				}
 
+				// ffmpeg writes the init segment first
+				s.saveInit(initRange)
+
 				// Check goal satisfied
 				if id >= s.goal {
-					log.Printf("%s-%s: goal satisfied: %d", s.m.id, s.quality, s.goal)
+					s.logger().Info("goal satisfied", "chunk", s.goal)
 					s.coder.Process.Signal(syscall.SIGSTOP)
+					s.m.sched.Release(s)
 				}
 			}()
 		}
 	}
 }
 
-func (s *Stream) monitorStderr(cmdStdErr io.ReadCloser) {
+// Log the stderr of ffmpeg, at most STDERR_BURST lines per
+// STDERR_INTERVAL, and keep its tail for failure reports.
+// The done channel (if any) is closed at the end of stderr.
+func (s *Stream) monitorStderr(cmdStdErr io.ReadCloser, coder *exec.Cmd, done chan bool) {
+	if done != nil {
+		defer close(done)
+	}
 	stderrReader := bufio.NewReader(cmdStdErr)
 
+	logger := s.logger()
+	if coder.Process != nil {
+		logger = logger.With("pid", coder.Process.Pid)
+	}
+
+	logged, suppressed := 0, 0
+	window := time.Now()
+
 	for {
 		line, err := stderrReader.ReadBytes('\n')
 		if err == io.EOF {
@@ -917,30 +1206,90 @@ func (s *Stream) monitorStderr(cmdStdErr io.ReadCloser) {
 				break
 			}
 		} else if err != nil {
-			log.Println(err)
+			logger.Error("could not read ffmpeg stderr", "err", err)
 			break
 		} else {
 			line = line[:(len(line) - 1)]
 		}
-		log.Println("ffmpeg-error:", string(line))
+
+		s.mutex.Lock()
+		s.addStderr(coder, string(line))
+		s.mutex.Unlock()
+
+		if time.Since(window) > STDERR_INTERVAL {
+			if suppressed > 0 {
+				logger.Warn("ffmpeg stderr suppressed", "lines", suppressed)
+			}
+			logged, suppressed = 0, 0
+			window = time.Now()
+		}
+
+		if logged < STDERR_BURST {
+			logger.Warn("ffmpeg stderr", "line", string(line))
+			logged++
+		} else {
+			suppressed++
+		}
+	}
+
+	if suppressed > 0 {
+		logger.Warn("ffmpeg stderr suppressed", "lines", suppressed)
 	}
 }
 
-func (s *Stream) monitorExit() {
-	// Join the process
-	coder := s.coder
+func (s *Stream) monitorExit(coder *exec.Cmd, stdoutDone chan bool, stderrDone chan bool) {
+	// Join the process once all of its output was read,
+	// since Wait closes the pipes
+	<-stdoutDone
+	<-stderrDone
 	err := coder.Wait()
 
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Free the slot for other streams
+	if s.coder == coder {
+		s.m.sched.Release(s)
+
+		// Reached the end of the video or of its keyframe window.
+		// Forget the coder so that it is not resumed and does not
+		// take a slot again.
+		if err == nil {
+			s.coder = nil
+
+			// Go on from the window for chunks being waited for
+			next := -1
+			for id, chunk := range s.chunks {
+				if !chunk.done && len(chunk.notifs) > 0 && (next == -1 || id < next) {
+					next = id
+				}
+			}
+			if next != -1 && s.pending == -1 {
+				s.goal = next + s.c.GoalBufferMax
+				s.transcode(next)
+			}
+		}
+	}
+
 	// Try to get exit status
 	if exitError, ok := err.(*exec.ExitError); ok {
 		exitcode := exitError.ExitCode()
-		log.Printf("%s-%s: ffmpeg exited with status: %d", s.m.id, s.quality, exitcode)
-
-		s.mutex.Lock()
-		defer s.mutex.Unlock()
+		s.logger().Info("ffmpeg exited", "pid", coder.Process.Pid, "status", exitcode)
 
 		// If error code is >0, there was an error in transcoding
 		if exitcode > 0 && s.coder == coder {
+			prev := s.failure
+			s.failure = newFailure(coder, exitcode, s.stderrTail)
+			if prev != nil && prev.Fallback != "" {
+				s.failure.Previous = prev
+			}
+			s.logger().Error("ffmpeg failed", "pid", coder.Process.Pid, "reason", s.failure.Reason, "message", s.failure.Message)
+
+			// Try another encoder if the hardware failed
+			if s.fallback() {
+				return
+			}
+
 			// Notify all outstanding chunks
 			for _, chunk := range s.chunks {
 				for _, n := range chunk.notifs {
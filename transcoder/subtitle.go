@@ -0,0 +1,367 @@
+package transcoder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	QUALITY_SUBTITLE = "sub"
+	SUBTITLE_GROUP   = "subs"
+
+	// Length of each WebVTT segment in seconds
+	SUBTITLE_SEGMENT_SIZE = 30
+
+	// Delay added to all timestamps by the MPEG-TS muxer
+	// (twice the default max_delay of 0.7s, at 90kHz)
+	MPEGTS_DELAY = 126000
+)
+
+// Text subtitle codecs that can be converted to WebVTT
+var textSubtitleCodecs = map[string]bool{
+	"subrip":   true,
+	"srt":      true,
+	"ass":      true,
+	"ssa":      true,
+	"mov_text": true,
+	"webvtt":   true,
+	"text":     true,
+}
+
+type ProbeSubtitleData struct {
+	Index     int    // among subtitle streams (0:s:N)
+	Path      string // sidecar file; empty for embedded streams
+	CodecName string
+	Language  string
+	Title     string
+	Default   bool
+	Forced    bool
+}
+
+// A subtitle track converted to segmented WebVTT. The conversion
+// runs on the first request, and again on the next request if it
+// failed.
+type Subtitle struct {
+	m     *Manager
+	name  string
+	probe *ProbeSubtitleData
+
+	mutex sync.Mutex
+	done  bool // converted successfully
+	cues  []*vttCue
+	err   error // of the last conversion
+}
+
+type vttCue struct {
+	start float64
+	end   float64
+	text  string // settings and payload after the timestamps
+}
+
+// Find sidecar subtitle files next to the source, e.g. for
+// /videos/movie.mkv: movie.srt, movie.en.srt, movie.de.forced.vtt
+func (m *Manager) findSidecarSubtitles() []*ProbeSubtitleData {
+	subs := make([]*ProbeSubtitleData, 0)
+	base := strings.TrimSuffix(m.path, filepath.Ext(m.path))
+
+	for _, ext := range []string{".srt", ".vtt"} {
+		matches, _ := filepath.Glob(globEscape(base) + "*" + ext)
+		for _, match := range matches {
+			// Anything between the base name and the extension
+			// are dot-separated tags (language, forced)
+			tags := strings.TrimSuffix(strings.TrimPrefix(match, base), ext)
+			if tags != "" && !strings.HasPrefix(tags, ".") {
+				continue // belongs to another video, e.g. movie2.srt
+			}
+
+			// Same restrictions as the source file
+			path, err := m.c.CheckPath(match)
+			if err != nil {
+				m.logger().Warn("skipping sidecar subtitle", "path", match, "err", err)
+				continue
+			}
+
+			sub := &ProbeSubtitleData{Path: path, CodecName: strings.TrimPrefix(ext, ".")}
+			for _, tag := range strings.Split(tags, ".") {
+				if tag == "forced" {
+					sub.Forced = true
+				} else if tag == "default" {
+					sub.Default = true
+				} else if tag != "" && sub.Language == "" {
+					sub.Language = tag
+				}
+			}
+			subs = append(subs, sub)
+		}
+	}
+
+	return subs
+}
+
+// Escape glob metacharacters in a path
+func globEscape(path string) string {
+	replacer := strings.NewReplacer("*", "\\*", "?", "\\?", "[", "\\[", "]", "\\]")
+	return replacer.Replace(path)
+}
+
+// Create a subtitle track for every text subtitle stream of the
+// source and every sidecar file. Tracks are named sub0, sub1, ...
+func (m *Manager) addSubtitles() {
+	m.subtitles = make(map[string]*Subtitle)
+
+	all := make([]*ProbeSubtitleData, 0)
+	for _, sub := range m.probe.Subtitles {
+		if textSubtitleCodecs[sub.CodecName] {
+			all = append(all, sub)
+		}
+	}
+	all = append(all, m.findSidecarSubtitles()...)
+
+	for i, sub := range all {
+		name := fmt.Sprintf("%s%d", QUALITY_SUBTITLE, i)
+		m.subtitles[name] = &Subtitle{m: m, name: name, probe: sub}
+	}
+}
+
+// Get the subtitle tracks in order
+func (m *Manager) subtitleList() []*Subtitle {
+	subs := make([]*Subtitle, 0)
+	for i := 0; i < len(m.subtitles); i++ {
+		if sub, ok := m.subtitles[fmt.Sprintf("%s%d", QUALITY_SUBTITLE, i)]; ok {
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}
+
+// Write EXT-X-MEDIA tags for all subtitle tracks
+func (m *Manager) writeSubtitleMedia(w http.ResponseWriter, query string) {
+	for _, sub := range m.subtitleList() {
+		media := fmt.Sprintf("#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"%s\",NAME=\"%s\"", SUBTITLE_GROUP, sub.Name())
+
+		if lang := sub.probe.Language; lang != "" && lang != "und" {
+			media += fmt.Sprintf(",LANGUAGE=\"%s\"", lang)
+		}
+
+		if sub.probe.Default {
+			media += ",DEFAULT=YES,AUTOSELECT=YES"
+		} else {
+			media += ",DEFAULT=NO,AUTOSELECT=YES"
+		}
+
+		if sub.probe.Forced {
+			media += ",FORCED=YES"
+		}
+
+		media += fmt.Sprintf(",URI=\"%s.m3u8%s\"\n", sub.name, query)
+		w.Write([]byte(media))
+	}
+}
+
+// Display name of the track for players
+func (sub *Subtitle) Name() string {
+	p := sub.probe
+	name := p.Title
+	if name == "" && p.Language != "" && p.Language != "und" {
+		name = p.Language
+	}
+	if name == "" {
+		name = fmt.Sprintf("Subtitles %s", strings.TrimPrefix(sub.name, QUALITY_SUBTITLE))
+	}
+	if p.Forced {
+		name += " (forced)"
+	}
+
+	// Quotes cannot be escaped in attribute values
+	return strings.ReplaceAll(name, "\"", "'")
+}
+
+func (sub *Subtitle) ServeList(w http.ResponseWriter, r *http.Request) error {
+	WriteM3U8ContentType(w)
+	w.Write([]byte("#EXTM3U\n"))
+	w.Write([]byte("#EXT-X-VERSION:3\n"))
+	w.Write([]byte("#EXT-X-MEDIA-SEQUENCE:0\n"))
+	w.Write([]byte("#EXT-X-PLAYLIST-TYPE:VOD\n"))
+	w.Write([]byte(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", SUBTITLE_SEGMENT_SIZE)))
+
+	query := GetQueryString(r)
+
+	duration := sub.m.probe.Duration.Seconds()
+	for i := 0; float64(i*SUBTITLE_SEGMENT_SIZE) < duration; i++ {
+		size := duration - float64(i*SUBTITLE_SEGMENT_SIZE)
+		if size > SUBTITLE_SEGMENT_SIZE {
+			size = SUBTITLE_SEGMENT_SIZE
+		}
+
+		w.Write([]byte(fmt.Sprintf("#EXTINF:%.3f,\n", size)))
+		w.Write([]byte(fmt.Sprintf("%s-%06d.vtt%s\n", sub.name, i, query)))
+	}
+
+	w.Write([]byte("#EXT-X-ENDLIST\n"))
+
+	return nil
+}
+
+func (sub *Subtitle) ServeChunk(w http.ResponseWriter, id int) error {
+	sub.mutex.Lock()
+	if !sub.done {
+		sub.convert()
+	}
+	cues, err := sub.cues, sub.err
+	sub.mutex.Unlock()
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+
+	start := float64(id * SUBTITLE_SEGMENT_SIZE)
+	end := start + SUBTITLE_SEGMENT_SIZE
+
+	w.Header().Set("Content-Type", "text/vtt")
+
+	// Cue times start with the video, whose timestamps are kept
+	// from the source (-copyts). MPEG-TS chunks are also delayed
+	// by the muxer; fMP4 chunks are not.
+	mpegts := int64(math.Round(sub.m.probe.StartTime * 90000))
+	if !sub.m.getClient().FMP4 {
+		mpegts += MPEGTS_DELAY
+	}
+	w.Write([]byte(fmt.Sprintf("WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:00:00:00.000\n\n", mpegts)))
+
+	// All cues overlapping the segment
+	for _, cue := range cues {
+		if cue.end > start && cue.start < end {
+			w.Write([]byte(fmt.Sprintf("%s --> %s%s\n\n", vttTimestamp(cue.start), vttTimestamp(cue.end), cue.text)))
+		}
+	}
+
+	return nil
+}
+
+// Convert the track to WebVTT with ffmpeg and parse the cues.
+// Must be called with lock held.
+func (sub *Subtitle) convert() {
+	args := []string{"-v", "error"}
+	if sub.probe.Path != "" {
+		args = append(args, []string{"-i", sub.probe.Path, "-map", "0:s:0"}...)
+	} else {
+		args = append(args, []string{
+			"-i", sub.m.path,
+			"-copyts", // Same timeline as the video
+			"-map", fmt.Sprintf("0:s:%d", sub.probe.Index),
+		}...)
+	}
+	args = append(args, []string{"-c:s", "webvtt", "-f", "webvtt", "-"}...)
+
+	ctx, cancel := context.WithDeadline(context.TODO(), time.Now().Add(60*time.Second))
+	defer cancel()
+	cmd := exec.CommandContext(ctx, sub.m.c.FFmpeg, args...)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		sub.m.logger().Error("subtitle conversion failed", "subtitle", sub.name, "err", err, "stderr", stderr.String())
+		sub.err = err
+		return
+	}
+
+	sub.cues = parseVTT(&stdout)
+	sub.done = true
+	sub.err = nil
+
+	// Embedded tracks are on the timeline of the source;
+	// make them start with the video like sidecar files
+	if sub.probe.Path == "" && sub.m.probe.StartTime != 0 {
+		for _, cue := range sub.cues {
+			cue.start -= sub.m.probe.StartTime
+			cue.end -= sub.m.probe.StartTime
+		}
+	}
+	sub.m.logger().Info("converted subtitle", "subtitle", sub.name, "cues", len(sub.cues))
+}
+
+// Parse the cues of a WebVTT file; cue identifiers are dropped
+func parseVTT(buf *bytes.Buffer) []*vttCue {
+	cues := make([]*vttCue, 0)
+	scanner := bufio.NewScanner(buf)
+
+	var cue *vttCue
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		// End of a block
+		if line == "" {
+			if cue != nil {
+				cues = append(cues, cue)
+				cue = nil
+			}
+			continue
+		}
+
+		// Payload of the current cue
+		if cue != nil {
+			cue.text += "\n" + line
+			continue
+		}
+
+		// Timing line starts a new cue
+		if idx := strings.Index(line, "-->"); idx >= 0 {
+			fields := strings.Fields(line[idx+3:])
+			if len(fields) == 0 {
+				continue
+			}
+
+			start, e1 := parseVTTTimestamp(strings.TrimSpace(line[:idx]))
+			end, e2 := parseVTTTimestamp(fields[0])
+			if e1 != nil || e2 != nil {
+				continue
+			}
+
+			// Keep the cue settings after the end time
+			settings := strings.TrimSpace(strings.TrimSpace(line[idx+3:])[len(fields[0]):])
+			if settings != "" {
+				settings = " " + settings
+			}
+
+			cue = &vttCue{start: start, end: end, text: settings}
+		}
+	}
+
+	if cue != nil {
+		cues = append(cues, cue)
+	}
+
+	return cues
+}
+
+// Parse hh:mm:ss.ttt or mm:ss.ttt
+func parseVTTTimestamp(ts string) (float64, error) {
+	parts := strings.Split(ts, ":")
+	secs := 0.0
+	for _, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, err
+		}
+		secs = secs*60 + v
+	}
+	return secs, nil
+}
+
+func vttTimestamp(secs float64) string {
+	ms := int64(secs*1000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, (ms/60000)%60, (ms/1000)%60, ms%1000)
+}
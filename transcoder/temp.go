@@ -1,38 +1,107 @@
 package transcoder
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strings"
 )
 
+// Stream the request body to a temp file. The upload is limited to
+// Config.MaxUploadSize and must match the Content-Length and the
+// X-Go-Vod-Sha256 header if given. The file is removed if anything
+// goes wrong, including the client going away.
 func (h *Handler) createTempFile(w http.ResponseWriter, r *http.Request, parts []string) (string, error) {
 	streamid := parts[0]
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		log.Println("Error reading body", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return "", err
+	maxSize := int64(h.c.MaxUploadSize) * 1024 * 1024
+
+	// Refuse early if the size is known
+	if maxSize > 0 && r.ContentLength > maxSize {
+		slog.Warn("upload too large", "length", r.ContentLength)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return "", errors.New("upload too large")
+	}
+
+	// Make room for the file
+	need := r.ContentLength
+	if need < 0 {
+		need = 0
+	}
+	if !h.storage.Reclaim(need) {
+		http.Error(w, "Not enough space for the temp file", http.StatusInsufficientStorage)
+		return "", errors.New("insufficient storage")
 	}
 
 	// Create temporary file
 	file, err := ioutil.TempFile(h.c.TempDir, streamid+"-govod-temp-")
 	if err != nil {
-		log.Println("Error creating temp file", err)
+		slog.Error("could not create temp file", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return "", err
 	}
 	defer file.Close()
 
-	// Write data to file
-	if _, err := file.Write(body); err != nil {
-		log.Println("Error writing to temp file", err)
+	// Remove the partial file on failure
+	ok := false
+	defer func() {
+		if !ok {
+			os.Remove(file.Name())
+		}
+	}()
+
+	body := r.Body
+	if maxSize > 0 {
+		body = http.MaxBytesReader(w, body, maxSize)
+	}
+
+	// Write data to file while hashing it
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(file, hash), body)
+	if err != nil {
+		if r.Context().Err() != nil {
+			slog.Info("client went away during upload", "err", err)
+			return "", err
+		}
+
+		slog.Error("could not write temp file", "err", err)
+		if maxSize > 0 && n >= maxSize {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		} else if errors.Is(err, io.ErrUnexpectedEOF) {
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return "", err
+	}
+
+	// Check that the upload is complete
+	if r.ContentLength >= 0 && n != r.ContentLength {
+		slog.Warn("upload size mismatch", "size", n, "expected", r.ContentLength)
+		w.WriteHeader(http.StatusBadRequest)
+		return "", errors.New("upload size mismatch")
+	}
+
+	if expected := r.Header.Get("X-Go-Vod-Sha256"); expected != "" {
+		actual := hex.EncodeToString(hash.Sum(nil))
+		if !strings.EqualFold(expected, actual) {
+			slog.Warn("upload checksum mismatch", "sha256", actual, "expected", expected)
+			w.WriteHeader(http.StatusBadRequest)
+			return "", errors.New("upload checksum mismatch")
+		}
+	}
+
+	if err := file.Sync(); err != nil {
+		slog.Error("could not write temp file", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return "", err
 	}
+	ok = true
 
 	// Return full path to file in JSON
 	w.Header().Set("Content-Type", "application/json")
@@ -42,8 +111,12 @@ func (h *Handler) createTempFile(w http.ResponseWriter, r *http.Request, parts [
 	return file.Name(), nil
 }
 
+func isTemp(path string) bool {
+	return strings.Contains(path, "-govod-temp-")
+}
+
 func freeIfTemp(path string) {
-	if strings.Contains(path, "-govod-temp-") {
+	if isTemp(path) {
 		os.Remove(path)
 	}
 }
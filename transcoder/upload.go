@@ -0,0 +1,332 @@
+package transcoder
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Idle time in seconds after which an unfinished upload is
+// removed if Config.UploadIdleTime is not set
+const UPLOAD_IDLE_TIME = 600
+
+// Uploads holds the sessions of resumable uploads. A session writes
+// to a temp file with the same naming as POST /create, so the file is
+// freed with the manager once it is finalized, or after the idle time
+// if no manager opens it. The protocol is:
+//
+//	POST  /<streamid>/upload/start  X-Go-Vod-Upload-Length, X-Go-Vod-Sha256
+//	PATCH /<streamid>/upload/<id>   X-Go-Vod-Upload-Offset, body appended
+//	GET   /<streamid>/upload/<id>   progress
+//	POST  /<streamid>/upload/<id>   finalize; returns the path like /create
+//
+// Every response is the JSON state of the session.
+type Uploads struct {
+	c       *Config
+	storage *Storage
+
+	mutex    sync.Mutex
+	sessions map[string]*Upload
+	finished map[string]time.Time // finalized files no manager opened yet
+}
+
+type Upload struct {
+	ID       string `json:"id"`
+	Offset   int64  `json:"offset"`
+	Length   int64  `json:"length"`
+	Path     string `json:"path,omitempty"` // only once finalized
+	streamid string
+	file     string
+	sha256   string
+	busy     bool // a chunk is being written
+	active   time.Time
+}
+
+func NewUploads(c *Config, storage *Storage) *Uploads {
+	return &Uploads{
+		c:        c,
+		storage:  storage,
+		sessions: make(map[string]*Upload),
+		finished: make(map[string]time.Time),
+	}
+}
+
+// Remove sessions that were idle for too long, and finished
+// files that no manager opened within the same time
+func (u *Uploads) Run() {
+	t := time.NewTicker(5 * time.Second)
+	defer t.Stop()
+
+	for range t.C {
+		idle := time.Duration(u.c.UploadIdleTime) * time.Second
+		if idle <= 0 {
+			idle = UPLOAD_IDLE_TIME * time.Second
+		}
+
+		u.mutex.Lock()
+		for id, up := range u.sessions {
+			if !up.busy && time.Since(up.active) > idle {
+				slog.Info("upload expired", "upload", id, "offset", up.Offset, "length", up.Length)
+				u.storage.Unreserve(up.file)
+				freeIfTemp(up.file)
+				delete(u.sessions, id)
+			}
+		}
+
+		// The manager frees the file once it is claimed
+		for file, finished := range u.finished {
+			if u.storage.Claimed(file) {
+				delete(u.finished, file)
+			} else if time.Since(finished) > idle {
+				slog.Info("finished upload expired", "path", file)
+				freeIfTemp(file)
+				delete(u.finished, file)
+			}
+		}
+		u.mutex.Unlock()
+	}
+}
+
+func (u *Uploads) ServeHTTP(w http.ResponseWriter, r *http.Request, streamid string, id string) {
+	if r.Method == "POST" && id == "start" {
+		u.start(w, r, streamid)
+		return
+	}
+
+	u.mutex.Lock()
+	up := u.sessions[id]
+	if up != nil && up.streamid != streamid {
+		up = nil
+	}
+	if up != nil {
+		up.active = time.Now()
+	}
+	u.mutex.Unlock()
+
+	if up == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		u.writeState(w, up, http.StatusOK)
+	case "PATCH":
+		u.patch(w, r, up)
+	case "POST":
+		u.finalize(w, up)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Create a session and its empty temp file
+func (u *Uploads) start(w http.ResponseWriter, r *http.Request, streamid string) {
+	length, err := strconv.ParseInt(r.Header.Get("X-Go-Vod-Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		slog.Warn("invalid upload length", "length", r.Header.Get("X-Go-Vod-Upload-Length"))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if maxSize := int64(u.c.MaxUploadSize) * 1024 * 1024; maxSize > 0 && length > maxSize {
+		slog.Warn("upload too large", "length", length)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	file, err := ioutil.TempFile(u.c.TempDir, streamid+"-govod-temp-")
+	if err != nil {
+		slog.Error("could not create temp file", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	file.Close()
+
+	// Make room for the whole file up front, and keep it
+	// so that concurrent uploads cannot take it
+	if !u.storage.Reserve(file.Name(), length) {
+		os.Remove(file.Name())
+		http.Error(w, "Not enough space for the temp file", http.StatusInsufficientStorage)
+		return
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		slog.Error("could not create upload id", "err", err)
+		u.storage.Unreserve(file.Name())
+		os.Remove(file.Name())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	up := &Upload{
+		ID:       hex.EncodeToString(idBytes),
+		Length:   length,
+		streamid: streamid,
+		file:     file.Name(),
+		sha256:   r.Header.Get("X-Go-Vod-Sha256"),
+		active:   time.Now(),
+	}
+
+	u.mutex.Lock()
+	u.sessions[up.ID] = up
+	u.mutex.Unlock()
+
+	slog.Info("upload started", "upload", up.ID, "length", length)
+	u.writeState(w, up, http.StatusOK)
+}
+
+// Append the body at the given offset, which must be the current
+// offset of the session. Whatever arrives is kept, so after a dropped
+// connection the client can query the offset and continue from there.
+func (u *Uploads) patch(w http.ResponseWriter, r *http.Request, up *Upload) {
+	offset, err := strconv.ParseInt(r.Header.Get("X-Go-Vod-Upload-Offset"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	u.mutex.Lock()
+	if up.busy || offset != up.Offset {
+		u.mutex.Unlock()
+		u.writeState(w, up, http.StatusConflict)
+		return
+	}
+	up.busy = true
+	u.mutex.Unlock()
+
+	f, err := os.OpenFile(up.file, os.O_WRONLY, 0600)
+	if err == nil {
+		// Drop anything after the offset from a failed write
+		if err = f.Truncate(offset); err == nil {
+			_, err = f.Seek(offset, io.SeekStart)
+		}
+	}
+	if err != nil {
+		slog.Error("could not open upload file", "upload", up.ID, "err", err)
+		if f != nil {
+			f.Close()
+		}
+		u.release(up, 0)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Write what remains, then read one byte more to detect overflow
+	remaining := up.Length - offset
+	n, err := io.Copy(f, io.LimitReader(r.Body, remaining))
+	if err == nil && n == remaining {
+		if extra, _ := io.ReadFull(r.Body, make([]byte, 1)); extra > 0 {
+			err = io.ErrShortBuffer
+		}
+	}
+	f.Close()
+	u.release(up, n)
+
+	if err == io.ErrShortBuffer {
+		slog.Warn("upload data beyond length", "upload", up.ID, "length", up.Length)
+		u.writeState(w, up, http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		slog.Info("upload interrupted", "upload", up.ID, "offset", offset+n, "err", err)
+		u.writeState(w, up, http.StatusBadRequest)
+		return
+	}
+
+	u.writeState(w, up, http.StatusOK)
+}
+
+// Advance the offset of the session after a chunk
+func (u *Uploads) release(up *Upload, n int64) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	up.Offset += n
+	up.busy = false
+	up.active = time.Now()
+}
+
+// Check the complete file and hand it over. The session is removed
+// and the temp file is now owned by the manager of the stream.
+func (u *Uploads) finalize(w http.ResponseWriter, up *Upload) {
+	u.mutex.Lock()
+	if up.busy || up.Offset != up.Length {
+		u.mutex.Unlock()
+		u.writeState(w, up, http.StatusConflict)
+		return
+	}
+	up.busy = true
+	u.mutex.Unlock()
+
+	// The data is wrong somewhere; start over
+	if info, err := os.Stat(up.file); err != nil || info.Size() != up.Length {
+		slog.Warn("upload size mismatch", "upload", up.ID, "length", up.Length, "err", err)
+		u.discard(up)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if up.sha256 != "" {
+		actual, err := fileSha256(up.file)
+		if err != nil || !strings.EqualFold(actual, up.sha256) {
+			slog.Warn("upload checksum mismatch", "upload", up.ID, "sha256", actual, "expected", up.sha256)
+			u.discard(up)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	u.mutex.Lock()
+	delete(u.sessions, up.ID)
+	u.finished[up.file] = time.Now()
+	u.mutex.Unlock()
+	u.storage.Unreserve(up.file)
+
+	up.Path = up.file
+	slog.Info("upload finished", "upload", up.ID, "path", up.Path)
+	u.writeState(w, up, http.StatusOK)
+}
+
+// Remove the session and its file
+func (u *Uploads) discard(up *Upload) {
+	u.mutex.Lock()
+	delete(u.sessions, up.ID)
+	u.mutex.Unlock()
+	u.storage.Unreserve(up.file)
+	freeIfTemp(up.file)
+}
+
+func (u *Uploads) writeState(w http.ResponseWriter, up *Upload, status int) {
+	u.mutex.Lock()
+	state := *up
+	u.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(state)
+}
+
+// Hex SHA-256 of the file
+func fileSha256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
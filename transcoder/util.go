@@ -1,6 +1,14 @@
 package transcoder
 
-import "net/http"
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
 
 func GetQueryString(r *http.Request) string {
 	query := r.URL.Query().Encode()
@@ -13,3 +21,71 @@ func GetQueryString(r *http.Request) string {
 func WriteM3U8ContentType(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/x-mpegURL")
 }
+
+func atoiOrZero(s string) int {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0
+	}
+	return i
+}
+
+// Parse a comma-separated list of codec names from a header
+func parseCodecList(list string) map[string]bool {
+	codecs := make(map[string]bool)
+	for _, codec := range strings.Split(list, ",") {
+		codec = strings.ToLower(strings.TrimSpace(codec))
+		if codec != "" {
+			codecs[codec] = true
+		}
+	}
+	return codecs
+}
+
+// Range of bytes in a file
+type byteRange struct {
+	offset int64
+	length int64
+}
+
+// Parse a byte range of the form "length@offset"
+func parseByteRange(s string) *byteRange {
+	parts := strings.Split(strings.TrimSpace(s), "@")
+	if len(parts) != 2 {
+		return nil
+	}
+
+	length, e1 := strconv.ParseInt(parts[0], 10, 64)
+	offset, e2 := strconv.ParseInt(parts[1], 10, 64)
+	if e1 != nil || e2 != nil {
+		return nil
+	}
+
+	return &byteRange{offset: offset, length: length}
+}
+
+// Copy a range of a file to a new file. The new file
+// is only visible once it is complete.
+func copyRange(src string, dst string, r *byteRange) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	_, err = io.Copy(out, io.NewSectionReader(in, r.offset, r.length))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(out.Name(), dst)
+}
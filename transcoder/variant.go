@@ -0,0 +1,131 @@
+package transcoder
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+)
+
+// Codecs of the additional variants, in order of preference
+var variantCodecs = []string{CODEC_HEVC, CODEC_AV1}
+
+// Bitrate of a variant relative to the H.264 stream of the same size.
+// The newer codecs need much less for about the same quality.
+var variantBitrateFactor = map[string]float64{
+	CODEC_HEVC: 0.6,
+	CODEC_AV1:  0.5,
+}
+
+// Get the encoder for variants of the given codec from the
+// configuration. Returns nil if the codec is disabled.
+func (c *Config) VariantEncoder(codec string) Encoder {
+	name := ""
+	switch codec {
+	case CODEC_HEVC:
+		if !c.HEVC {
+			return nil
+		}
+		name = c.HEVCEncoder
+		if name == "" {
+			if c.VAAPI {
+				name = ENCODER_VAAPI_HEVC
+			} else if c.NVENC {
+				name = ENCODER_NVENC_HEVC
+			} else {
+				name = ENCODER_X265
+			}
+		}
+	case CODEC_AV1:
+		if !c.AV1 {
+			return nil
+		}
+		name = c.AV1Encoder
+		if name == "" {
+			name = ENCODER_SVTAV1
+		}
+	}
+
+	// H.264 remains available, so there is no fallback here
+	e := GetEncoder(name)
+	if e == nil {
+		slog.Warn("unknown encoder, disabling variants", "codec", codec, "encoder", name)
+	}
+	return c.healthyEncoder(e)
+}
+
+// Create a variant of every video stream for each enabled codec.
+// Variants are named after the stream, e.g. 1080p_hevc or max_av1,
+// and share its size and audio renditions.
+func (m *Manager) addVideoVariants() {
+	video := make([]*Stream, 0)
+	for _, stream := range m.streams {
+		if stream.audio == nil {
+			video = append(video, stream)
+		}
+	}
+
+	for _, codec := range variantCodecs {
+		encoder := m.c.VariantEncoder(codec)
+		if encoder == nil {
+			continue
+		}
+
+		for _, vs := range video {
+			quality := variantQuality(vs.quality, codec)
+			variant := &Stream{
+				c: m.c, m: m,
+				quality:    quality,
+				order:      vs.order,
+				height:     vs.height,
+				width:      vs.width,
+				bitrate:    int(math.Ceil(float64(vs.bitrate) * variantBitrateFactor[codec])),
+				encoder:    encoder,
+				audioGroup: vs.audioGroup,
+				pending:    -1,
+			}
+
+			// Remux the original stream if it already is this codec
+			if vs.quality == QUALITY_MAX && m.canCopy(codec) {
+				m.logger().Info("remuxing original stream", "quality", quality, "keyframes", len(m.keyframes.Keyframes))
+				variant.encoder = GetEncoder(ENCODER_COPY)
+				variant.bitrate = m.probe.BitRate
+				variant.segments = m.keyframes.Segments(0) // one chunk per keyframe
+				variant.aligned = true
+			}
+
+			m.streams[quality] = variant
+		}
+	}
+}
+
+func variantQuality(quality string, codec string) string {
+	return fmt.Sprintf("%s_%s", quality, codec)
+}
+
+// Video codecs the client can play besides H.264,
+// e.g. "X-Go-Vod-Video-Codecs: hevc,av1"
+func clientVideoCodecs(r *http.Request) map[string]bool {
+	codecs := parseCodecList(r.Header.Get("X-Go-Vod-Video-Codecs"))
+
+	// Accept the sample entry names of the codecs too
+	aliases := map[string]string{"hvc1": CODEC_HEVC, "hev1": CODEC_HEVC, "h265": CODEC_HEVC, "av01": CODEC_AV1}
+	for alias, codec := range aliases {
+		if codecs[alias] {
+			codecs[codec] = true
+		}
+	}
+
+	codecs[CODEC_H264] = true
+	return codecs
+}
+
+// Codec of the video of this stream
+func (s *Stream) videoCodec() string {
+	return s.encoder.Profile(s).Codec
+}
+
+// HEVC and AV1 are only segmented as fMP4 with an init segment
+func (s *Stream) fmp4Only() bool {
+	return s.audio == nil && s.videoCodec() != CODEC_H264
+}